@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/subtle"
+	encjson "encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	maxAdminBody = 1 << 20
+
+	// redacted replaces the credentials in responses, it keeps the stored
+	// value if it is sent back. In urls the password is replaced by
+	// redactedUrl, like url.URL.Redacted does for the log.
+	redacted    = "********"
+	redactedUrl = "xxxxx"
+)
+
+var feedName = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+// adminAPI manages the named feeds at runtime. It is protected by its own
+// credentials and every change is written to the config file, so it
+// survives a restart.
+type adminAPI struct {
+	user      string
+	password  string
+	path      string
+	scheduler *scheduler
+
+	mu   sync.Mutex
+	conf *config
+}
+
+// feedResource is a named feed as returned by the API, without its
+// credentials.
+type feedResource struct {
+	*feedConfig
+	Status feedStatus `json:"status"`
+}
+
+func (a *adminAPI) resource(fc *feedConfig) feedResource {
+	return feedResource{redactFeed(fc), a.scheduler.status(fc)}
+}
+
+func newAdminAPI(user, password, path string, conf *config, scheduler *scheduler) *adminAPI {
+	return &adminAPI{
+		user:      user,
+		password:  password,
+		path:      path,
+		scheduler: scheduler,
+		conf:      conf,
+	}
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	info(r).pipeline = "api"
+	user, pass, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(a.password)) != 1 {
+		w.Header().Add("WWW-Authenticate", "Basic realm=\"rss-filter admin\", charset=\"UTF-8\"")
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	// browsers send the cached credentials along with cross-site form
+	// posts, they don't prove the change was intended
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && crossSite(r) {
+		writeError(w, http.StatusForbidden, "cross-site request")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	switch {
+	case path == "feeds":
+		switch r.Method {
+		case http.MethodGet:
+			a.listFeeds(w)
+		case http.MethodPost:
+			a.putFeed(w, r, "")
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case path == "opml":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		a.importOPML(w, r)
+	case path == "validate":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		a.validate(w, r)
+	case strings.HasPrefix(path, "feeds/"):
+		name := strings.TrimPrefix(path, "feeds/")
+		if n := strings.TrimSuffix(name, "/refresh"); n != name {
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, http.MethodPost)
+				return
+			}
+			a.refresh(w, r, n)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			a.getFeed(w, name)
+		case http.MethodPut:
+			a.putFeed(w, r, name)
+		case http.MethodDelete:
+			a.deleteFeed(w, name)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (a *adminAPI) listFeeds(w http.ResponseWriter) {
+	list := []feedResource{}
+	for _, fc := range a.scheduler.list() {
+		list = append(list, a.resource(fc))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"feeds": list})
+}
+
+func (a *adminAPI) getFeed(w http.ResponseWriter, name string) {
+	fc, ok := a.scheduler.feed(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown feed: %s", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.resource(fc))
+}
+
+// putFeed creates a feed (POST, name is empty) or creates or replaces
+// the named feed (PUT).
+func (a *adminAPI) putFeed(w http.ResponseWriter, r *http.Request, name string) {
+	if !hasContentType(r, "application/json") {
+		writeError(w, http.StatusUnsupportedMediaType, "expected Content-Type: application/json")
+		return
+	}
+	fc := new(feedConfig)
+	dec := encjson.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fc); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("can't parse feed: %s", err.Error()))
+		return
+	}
+	if name != "" {
+		if fc.Name != "" && fc.Name != name {
+			writeError(w, http.StatusBadRequest, "the name of the feed doesn't match the url")
+			return
+		}
+		fc.Name = name
+	}
+	if !feedName.MatchString(fc.Name) {
+		writeError(w, http.StatusBadRequest, "the name may only contain letters, digits and . _ ~ -")
+		return
+	}
+	if err := fc.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var old *feedConfig
+	for _, c := range a.conf.Feeds {
+		if c.Name == fc.Name {
+			old = c
+		}
+	}
+	if err := restoreSecrets(fc, old); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	feeds := make([]*feedConfig, 0, len(a.conf.Feeds)+1)
+	created := true
+	for _, c := range a.conf.Feeds {
+		if c.Name == fc.Name {
+			if name == "" {
+				writeError(w, http.StatusConflict, fmt.Sprintf("feed exists: %s", fc.Name))
+				return
+			}
+			created = false
+			c = fc
+		}
+		feeds = append(feeds, c)
+	}
+	if created {
+		feeds = append(feeds, fc)
+	}
+	if err := a.save(feeds); err != nil {
+		log.Err(err).Str("config", a.path).Msg("can't save config")
+		writeError(w, http.StatusInternalServerError, "can't save config")
+		return
+	}
+	a.scheduler.set(fc)
+	if a.scheduler.store == nil && fc.keepsHistory() {
+		log.Warn().Str("feed", fc.Name).Msg("feed keeps history, but no store is configured")
+	}
+	log.Info().Str("feed", fc.Name).Bool("created", created).Msg("feed saved")
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		w.Header().Set("Location", "/api/feeds/"+url.PathEscape(fc.Name))
+	}
+	writeJSON(w, status, a.resource(fc))
+}
+
+func (a *adminAPI) deleteFeed(w http.ResponseWriter, name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	feeds := make([]*feedConfig, 0, len(a.conf.Feeds))
+	for _, c := range a.conf.Feeds {
+		if c.Name != name {
+			feeds = append(feeds, c)
+		}
+	}
+	if len(feeds) == len(a.conf.Feeds) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown feed: %s", name))
+		return
+	}
+	if err := a.save(feeds); err != nil {
+		log.Err(err).Str("config", a.path).Msg("can't save config")
+		writeError(w, http.StatusInternalServerError, "can't save config")
+		return
+	}
+	a.scheduler.remove(name)
+	log.Info().Str("feed", name).Msg("feed deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refresh polls the feed now and returns its status.
+func (a *adminAPI) refresh(w http.ResponseWriter, r *http.Request, name string) {
+	if _, ok := a.scheduler.refresh(r.Context(), name); !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown feed: %s", name))
+		return
+	}
+	a.getFeed(w, name)
+}
+
+// validate parses the filter, the rules and the score rules of the
+// request and returns the conditions of the filter or the parse error.
+func (a *adminAPI) validate(w http.ResponseWriter, r *http.Request) {
+	if !hasContentType(r, "application/json") {
+		writeError(w, http.StatusUnsupportedMediaType, "expected Content-Type: application/json")
+		return
+	}
+	var req struct {
+		Filter string   `json:"filter"`
+		Rules  []string `json:"rules"`
+		Score  []string `json:"score"`
+	}
+	if err := encjson.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("can't parse request: %s", err.Error()))
+		return
+	}
+	t, err := parseFilter(req.Filter)
+	if err == nil {
+		_, err = parseFilterRules(req.Rules)
+	}
+	if err == nil {
+		_, err = parseScoring(req.Score, 0, false)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"valid": false, "error": err.Error()})
+		return
+	}
+	conditions := []string{}
+	for _, c := range t.Conditions() {
+		conditions = append(conditions, conditionString(c))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"valid": true, "conditions": conditions})
+}
+
+// redactFeed returns a copy of the feed with its credentials and the
+// credentials of its notification sinks replaced by redacted, including
+// the passwords in their urls.
+func redactFeed(fc *feedConfig) *feedConfig {
+	c := *fc
+	redact(&c.Password)
+	redactUserinfo(&c.URL)
+	c.Notify = make([]*notifyConfig, len(fc.Notify))
+	for i, nc := range fc.Notify {
+		c.Notify[i] = redactNotify(nc)
+	}
+	return &c
+}
+
+func redactNotify(nc *notifyConfig) *notifyConfig {
+	n := *nc
+	redact(&n.Token)
+	redact(&n.Password)
+	redactUserinfo(&n.URL)
+	return &n
+}
+
+func redact(s *string) {
+	if *s != "" {
+		*s = redacted
+	}
+}
+
+// redactUserinfo replaces the password of a url with redactedUrl.
+func redactUserinfo(s *string) {
+	*s = redactUrl(*s)
+}
+
+// restoreSecrets replaces the redacted credentials of a feed, as returned
+// by the API, with the credentials of the stored feed. A notification sink
+// is matched by its id.
+func restoreSecrets(fc, old *feedConfig) error {
+	if old == nil {
+		old = new(feedConfig)
+	}
+	if err := restore(&fc.Password, old.Password, "password"); err != nil {
+		return err
+	}
+	if err := restoreUserinfo(&fc.URL, old.URL, "url password"); err != nil {
+		return err
+	}
+	for _, nc := range fc.Notify {
+		prev := new(notifyConfig)
+		for _, o := range old.Notify {
+			if o.id() == nc.id() || redactNotify(o).id() == nc.id() {
+				prev = o
+			}
+		}
+		if err := restore(&nc.Token, prev.Token, nc.Type+" token"); err != nil {
+			return err
+		}
+		if err := restore(&nc.Password, prev.Password, nc.Type+" password"); err != nil {
+			return err
+		}
+		if err := restoreUserinfo(&nc.URL, prev.URL, nc.Type+" url password"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restore(secret *string, stored, name string) error {
+	if *secret != redacted {
+		return nil
+	}
+	if stored == "" {
+		return fmt.Errorf("the %s is redacted, but none is stored", name)
+	}
+	*secret = stored
+	return nil
+}
+
+// restoreUserinfo replaces a redacted password in a url with the password
+// of the stored url.
+func restoreUserinfo(s *string, stored, name string) error {
+	u, err := url.Parse(*s)
+	if err != nil || u.User == nil {
+		return nil
+	}
+	if password, ok := u.User.Password(); !ok || password != redactedUrl {
+		return nil
+	}
+	var password string
+	if su, err := url.Parse(stored); err == nil && su.User != nil {
+		password, _ = su.User.Password()
+	}
+	if password == "" {
+		return fmt.Errorf("the %s is redacted, but none is stored", name)
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	*s = u.String()
+	return nil
+}
+
+// crossSite reports whether a browser sent the request from another site,
+// according to Sec-Fetch-Site or else Origin. Other clients send neither.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return false
+	case "":
+	default:
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	return origin != "" && origin != requestBaseUrl(r)
+}
+
+// hasContentType reports whether the media type of the request body is
+// one of the given types.
+func hasContentType(r *http.Request, types ...string) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the feeds to the config file and keeps them, a.mu must be
+// held.
+func (a *adminAPI) save(feeds []*feedConfig) error {
+	conf := &config{Feeds: feeds}
+	data, err := encjson.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the config contains credentials, keep the permissions of an
+	// existing file
+	perm := os.FileMode(0600)
+	if fi, err := os.Stat(a.path); err == nil {
+		perm = fi.Mode().Perm()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := writeFile(a.path, append(data, '\n'), perm); err != nil {
+		return err
+	}
+	a.conf = conf
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := encjson.MarshalIndent(v, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxStale        = 24 * time.Hour
+	defaultMaxStaleEntries = 1000
+)
+
+// staleEntry is the last successfully filtered version of a feed.
+type staleEntry struct {
+	key         string
+	body        []byte
+	contentType string
+	stored      time.Time
+}
+
+// staleCache remembers the last successfully filtered version of the
+// requested feeds, so it can be served if the upstream fails
+// (stale-if-error). It holds at most maxEntries feeds, the least recently
+// used one is evicted first.
+type staleCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	maxStale   time.Duration
+	maxEntries int
+}
+
+// staleKey returns the key of a filtered feed, the query and the
+// credentials for the upstream. Only a hash of the credentials is kept,
+// a request with other credentials doesn't get the stale copy.
+func staleKey(query url.Values, user, password string) string {
+	h := sha256.Sum256([]byte(user + "\x00" + password))
+	// Encode sorts the parameters, so the key doesn't depend on their order
+	return query.Encode() + "\x00" + hex.EncodeToString(h[:])
+}
+
+func newStaleCache(maxStale time.Duration) *staleCache {
+	return &staleCache{
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		maxStale:   maxStale,
+		maxEntries: defaultMaxStaleEntries,
+	}
+}
+
+func (c *staleCache) put(key string, body []byte, contentType string) {
+	if c.maxStale <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &staleEntry{
+		key:         key,
+		body:        body,
+		contentType: contentType,
+		stored:      time.Now(),
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// get returns the entry for key if it is not older than the configured
+// max staleness. Expired entries are removed.
+func (c *staleCache) get(key string) (staleEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		staleLookups.inc("miss")
+		return staleEntry{}, false
+	}
+	e := el.Value.(*staleEntry)
+	if time.Since(e.stored) > c.maxStale {
+		c.remove(el)
+		staleLookups.inc("miss")
+		return staleEntry{}, false
+	}
+	c.lru.MoveToFront(el)
+	staleLookups.inc("hit")
+	return *e, true
+}
+
+// len returns the number of cached feeds.
+func (c *staleCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *staleCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*staleEntry).key)
+}
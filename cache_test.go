@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleCache(t *testing.T) {
+	c := newStaleCache(time.Hour)
+	c.maxEntries = 2
+	c.put("a", []byte("a"), "text/plain")
+	c.put("b", []byte("b"), "text/plain")
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a: expected an entry")
+	}
+	c.put("c", []byte("c"), "text/plain")
+	if _, ok := c.get("b"); ok {
+		t.Error("b: the least recently used entry should be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if e, ok := c.get(key); !ok || string(e.body) != key {
+			t.Errorf("%s: got %q, %t", key, e.body, ok)
+		}
+	}
+	c.put("c", []byte("c2"), "text/plain")
+	if e, _ := c.get("c"); string(e.body) != "c2" || c.len() != 2 {
+		t.Errorf("replaced entry: got %q, %d entries", e.body, c.len())
+	}
+
+	c.entries["a"].Value.(*staleEntry).stored = time.Now().Add(-2 * time.Hour)
+	if _, ok := c.get("a"); ok {
+		t.Error("a: expected the entry to be expired")
+	}
+	if c.len() != 1 {
+		t.Errorf("expired entry not removed, %d entries", c.len())
+	}
+
+	disabled := newStaleCache(0)
+	disabled.put("a", []byte("a"), "text/plain")
+	if disabled.len() != 0 {
+		t.Error("disabled cache stored an entry")
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	var fail atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", "feeds", "rss20.xml"))
+	}))
+	t.Cleanup(upstream.Close)
+	_, h := newTestServer(t)
+
+	rec := request(t, h, url.Values{"feed_url": {upstream.URL}, "filter": {`Title ~= "Bonn"`}, "out": {"atom"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	fail.Store(true)
+	// the same query with the parameters in a different order
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?out=atom&filter="+url.QueryEscape(`Title ~= "Bonn"`)+"&feed_url="+url.QueryEscape(upstream.URL), nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Warning") == "" {
+		t.Errorf("stale: status %d, warning %q", rec.Code, rec.Header().Get("Warning"))
+	}
+
+	rec = request(t, h, url.Values{"feed_url": {upstream.URL}, "filter": {`Title ~= "Cologne"`}})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("other filter: status %d", rec.Code)
+	}
+}
+
+func TestServeStaleCredentials(t *testing.T) {
+	var fail atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", "feeds", "rss20.xml"))
+	}))
+	t.Cleanup(upstream.Close)
+	_, h := newTestServer(t)
+
+	get := func(user, pass string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/?"+url.Values{"feed_url": {upstream.URL}}.Encode(), nil)
+		r.Header.Set("x-forward-user", user)
+		r.Header.Set("x-forward-password", pass)
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	if rec := get("alice", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	fail.Store(true)
+	tests := []struct {
+		user, pass string
+		status     int
+	}{
+		{"alice", "secret", http.StatusOK},
+		{"alice", "wrong", http.StatusServiceUnavailable},
+		{"alice", "", http.StatusServiceUnavailable},
+		{"bob", "secret", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if rec := get(tt.user, tt.pass); rec.Code != tt.status {
+			t.Errorf("%s:%s: status %d, want %d", tt.user, tt.pass, rec.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// filterOptions are the flags of the filter and explain commands.
+type filterOptions struct {
+	url       string
+	file      string
+	filter    string
+	rules     []string
+	out       string
+	write     string
+	user      string
+	password  string
+	score     []string
+	threshold float64
+	showScore bool
+	sort      string
+	order     string
+	limit     int
+	offset    int
+}
+
+// runFilter filters a single feed like the HTTP handler does and writes
+// the result to stdout or the file given by opts.write.
+func runFilter(ctx context.Context, f *fetcher, timeout time.Duration, opts filterOptions, stdin io.Reader, stdout io.Writer) error {
+	t, err := parseFilter(opts.filter)
+	if err != nil {
+		return fmt.Errorf("can't parse filter: %w", err)
+	}
+	fr, err := parseFilterRules(opts.rules)
+	if err != nil {
+		return err
+	}
+	sc, err := parseScoring(opts.score, opts.threshold, opts.showScore)
+	if err != nil {
+		return fmt.Errorf("can't parse score: %w", err)
+	}
+	lo := listOptions{sort: strings.ToLower(opts.sort), order: strings.ToLower(opts.order), limit: opts.limit, offset: opts.offset}
+	if err := lo.validate(); err != nil {
+		return err
+	}
+	fm := parseFormat(opts.out)
+	feed, err := loadFeed(ctx, f, timeout, opts, stdin)
+	if err != nil {
+		return err
+	}
+
+	newFeed, categories := filterFeed(feed, t, fr, sc, lo)
+	body, _, err := renderFeed(newFeed, categories, resolveFormat(fm, feed))
+	if err != nil {
+		return err
+	}
+	log.Debug().Int("original_items", len(feed.Items)).Int("kept_items", len(newFeed.Items)).Msg("feed filtered")
+	return writeOutput(opts.write, []byte(body), stdout)
+}
+
+// runExplain writes the explanation of the filter for every item of the
+// feed as JSON to stdout or the file given by opts.write.
+func runExplain(ctx context.Context, f *fetcher, timeout time.Duration, opts filterOptions, stdin io.Reader, stdout io.Writer) error {
+	t, err := parseFilter(opts.filter)
+	if err != nil {
+		return fmt.Errorf("can't parse filter: %w", err)
+	}
+	fr, err := parseFilterRules(opts.rules)
+	if err != nil {
+		return err
+	}
+	sc, err := parseScoring(opts.score, opts.threshold, false)
+	if err != nil {
+		return fmt.Errorf("can't parse score: %w", err)
+	}
+	feed, err := loadFeed(ctx, f, timeout, opts, stdin)
+	if err != nil {
+		return err
+	}
+
+	e := explainFeed(feed, t, fr, sc)
+	e.FeedUrl = redactUrl(opts.url)
+	e.Filter = opts.filter
+	data, err := e.marshal()
+	if err != nil {
+		return err
+	}
+	return writeOutput(opts.write, data, stdout)
+}
+
+// loadFeed fetches the feed from opts.url or reads it from opts.file or
+// stdin.
+func loadFeed(ctx context.Context, f *fetcher, timeout time.Duration, opts filterOptions, stdin io.Reader) (*gofeed.Feed, error) {
+	if opts.url != "" && opts.file != "" {
+		return nil, errors.New("use either a feed url or a file")
+	}
+	if opts.url != "" {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		up, err := f.fetch(ctx, opts.url, opts.user, opts.password)
+		if err != nil {
+			return nil, err
+		}
+		return up.feed, nil
+	}
+
+	in := stdin
+	if opts.file != "" && opts.file != "-" {
+		file, err := os.Open(opts.file)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	feed, err := parseFeed(data)
+	if err != nil {
+		return nil, &parseError{err: err}
+	}
+	return feed, nil
+}
+
+// writeOutput writes data to stdout, or to the file if one is given.
+func writeOutput(name string, data []byte, stdout io.Writer) error {
+	if name == "" || name == "-" {
+		_, err := stdout.Write(data)
+		return err
+	}
+	return writeFile(name, data, 0644)
+}
+
+// writeFile replaces the file atomically, so a web server or feed reader
+// never sees a partially written feed.
+func writeFile(name string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
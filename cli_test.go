@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunFilter(t *testing.T) {
+	upstream, _ := newTestServer(t)
+	rss20 := filepath.Join("testdata", "feeds", "rss20.xml")
+	tests := []struct {
+		name string
+		opts filterOptions
+		in   string
+		want []string
+		err  bool
+	}{
+		{"file", filterOptions{file: rss20, filter: `Title ~= "^Breaking"`}, "", []string{"Breaking: Cologne cathedral closed"}, false},
+		{"stdin", filterOptions{filter: `Title ~! "^Breaking"`, out: "json"}, string(readFixture(t, "feeds/rss20.xml")), []string{"Bonn opens new bridge", "Sports: Bonn wins"}, false},
+		{"url", filterOptions{url: upstream.URL + "/atom10.xml", filter: `Title ~! "^Breaking"`, out: "rss"}, "", []string{"Release 1.0", "Release 1.0.1"}, false},
+		{"url and file", filterOptions{url: upstream.URL + "/atom10.xml", file: rss20}, "", nil, true},
+		{"invalid filter", filterOptions{file: rss20, filter: `Title "Bonn"`}, "", nil, true},
+		{"invalid feed", filterOptions{}, "<html></html>", nil, true},
+		{"missing file", filterOptions{file: "testdata/feeds/missing.xml"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := runFilter(context.Background(), newFetcher(0), 0, tt.opts, strings.NewReader(tt.in), out)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got:\n%s", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := titles(t, out.String()); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunFilterWrite(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "feed.xml")
+	opts := filterOptions{file: filepath.Join("testdata", "feeds", "rdf.xml"), out: "atom", write: name}
+	out := &bytes.Buffer{}
+	if err := runFilter(context.Background(), newFetcher(0), 0, opts, nil, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected output on stdout: %s", out)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `<feed xmlns="http://www.w3.org/2005/Atom">`) {
+		t.Errorf("not an Atom feed:\n%s", data)
+	}
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(name), "*"))
+	if len(files) != 1 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
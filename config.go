@@ -0,0 +1,166 @@
+package main
+
+import (
+	encjson "encoding/json"
+	"fmt"
+	"github.com/rverst/goql"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInterval     = 15 * time.Minute
+	defaultArchivePages = 100
+)
+
+// duration is a time.Duration that is read from and written to JSON
+// as a string like "15m".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return encjson.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := encjson.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// feedConfig is a named feed, it is polled in the background and
+// served from memory.
+type feedConfig struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Filter   string   `json:"filter,omitempty"`
+	Out      string   `json:"out,omitempty"`
+	Interval duration `json:"interval,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Password string   `json:"password,omitempty"`
+
+	// Timeout limits a poll of the feed including retries, the server's
+	// request timeout is used if it is not set.
+	Timeout duration `json:"timeout,omitempty"`
+
+	// HistoryItems and HistoryDays enable the item store for the feed,
+	// the output then contains the last N kept items or the kept items
+	// of the last N days, even if they dropped off the upstream feed.
+	HistoryItems int `json:"history_items,omitempty"`
+	HistoryDays  int `json:"history_days,omitempty"`
+
+	// Notify are the sinks that are notified about newly matched items.
+	Notify []*notifyConfig `json:"notify,omitempty"`
+
+	// Rules like `if feed.Language == "de" then Title has word "Bonn"`
+	// apply a filter to the items that match the if part.
+	Rules []string `json:"rules,omitempty"`
+
+	// Score are rules like `Title ~= "Bonn" => +5`, items that passed the
+	// filter are only kept if their score is above Threshold. ShowScore
+	// adds the score to the items as a category.
+	Score     []string `json:"score,omitempty"`
+	Threshold float64  `json:"threshold,omitempty"`
+	ShowScore bool     `json:"show_score,omitempty"`
+
+	// Sort, Order, Limit and Offset sort the kept items and cut a page
+	// out of them. With a history and a limit, older items are available
+	// in the archive of the feed, it keeps the last ArchivePages pages.
+	Sort         string `json:"sort,omitempty"`
+	Order        string `json:"order,omitempty"`
+	Limit        int    `json:"limit,omitempty"`
+	Offset       int    `json:"offset,omitempty"`
+	ArchivePages int    `json:"archive_pages,omitempty"`
+
+	conditions goql.Conditions
+	rules      filterRules
+	scoring    *scoring
+}
+
+func (fc *feedConfig) listOptions() listOptions {
+	return listOptions{sort: strings.ToLower(fc.Sort), order: strings.ToLower(fc.Order), limit: fc.Limit, offset: fc.Offset}
+}
+
+// keepsHistory reports whether the kept items of the feed are stored.
+func (fc *feedConfig) keepsHistory() bool {
+	return fc.HistoryItems > 0 || fc.HistoryDays > 0
+}
+
+type config struct {
+	Feeds []*feedConfig `json:"feeds"`
+}
+
+// loadConfig reads the JSON config file at path and validates the
+// configured feeds.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := new(config)
+	if err := encjson.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("can't parse config: %w", err)
+	}
+
+	names := map[string]bool{}
+	for _, fc := range c.Feeds {
+		if err := fc.validate(); err != nil {
+			return nil, err
+		}
+		if names[fc.Name] {
+			return nil, fmt.Errorf("duplicate feed name: %s", fc.Name)
+		}
+		names[fc.Name] = true
+	}
+	return c, nil
+}
+
+// validate checks the feed and parses its filter.
+func (fc *feedConfig) validate() error {
+	if fc.Name == "" {
+		return fmt.Errorf("feed without name")
+	}
+	if fc.URL == "" {
+		return fmt.Errorf("feed %s: no url", fc.Name)
+	}
+	t, err := parseFilter(fc.Filter)
+	if err != nil {
+		return fmt.Errorf("feed %s: can't parse filter: %w", fc.Name, err)
+	}
+	fc.conditions = t
+	fr, err := parseFilterRules(fc.Rules)
+	if err != nil {
+		return fmt.Errorf("feed %s: %w", fc.Name, err)
+	}
+	fc.rules = fr
+	sc, err := parseScoring(fc.Score, fc.Threshold, fc.ShowScore)
+	if err != nil {
+		return fmt.Errorf("feed %s: %w", fc.Name, err)
+	}
+	fc.scoring = sc
+	if err := fc.listOptions().validate(); err != nil {
+		return fmt.Errorf("feed %s: %w", fc.Name, err)
+	}
+	if fc.ArchivePages < 0 {
+		return fmt.Errorf("feed %s: archive_pages must not be negative", fc.Name)
+	}
+	for _, nc := range fc.Notify {
+		if err := nc.validate(); err != nil {
+			return fmt.Errorf("feed %s: %w", fc.Name, err)
+		}
+	}
+	if fc.Interval <= 0 {
+		fc.Interval = duration(defaultInterval)
+	}
+	if fc.ArchivePages == 0 && fc.keepsHistory() && fc.Limit > 0 {
+		fc.ArchivePages = defaultArchivePages
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/rverst/goql"
+	"golang.org/x/net/html"
+	"golang.org/x/text/unicode/norm"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// checkItem evaluates the conditions for the item of the feed like goql's
+// CheckStruct does: from left to right without precedence, and an error
+// stops the evaluation. Relative dates are evaluated against now.
+func checkItem(t goql.Conditions, feed *gofeed.Feed, item *gofeed.Item, now time.Time) (bool, error) {
+	r := false
+	for _, c := range t.Conditions() {
+		m, err := evalCondition(c, feed, item, now)
+		if err != nil {
+			return false, err
+		}
+		switch c.Link {
+		case goql.LNK_AND:
+			r = r && m != c.Negate
+		case goql.LNK_OR:
+			r = r || m != c.Negate
+		default:
+			// like goql, the negation of the first condition is ignored
+			r = m
+		}
+	}
+	return r, nil
+}
+
+// evalCondition returns the result of the comparison of the condition,
+// without its link and negation. Values of the item that goql supports
+// are compared by goql, unless the operator is one goql doesn't know.
+// Text is compared in NFC, and unless it is a regular expression the value
+// of the condition is normalized like the key, e.g. for fold(Title).
+func evalCondition(c *goql.Condition, feed *gofeed.Feed, item *gofeed.Item, now time.Time) (bool, error) {
+	v, err := itemValue(feed, item, c.Key, now)
+	if err != nil {
+		return false, err
+	}
+	single := *c
+	single.Link = goql.EOF
+	single.Negate = false
+	if !isRegex(c.Operator) {
+		normalize := valueNormalizer(c.Key)
+		if c.Operator == opIn {
+			single.Expression = normalizeList(c.Expression, normalize)
+		} else if c.ExprType == goql.LITERAL {
+			single.Expression = normalize(c.Expression)
+		}
+	}
+	if !isGoqlOperator(c.Operator) {
+		if list, ok := v.([]string); ok {
+			return compareList(&single, list)
+		}
+		return compareString(&single, valueString(v))
+	}
+	switch x := v.(type) {
+	case time.Duration:
+		return compareDuration(&single, x)
+	case time.Time:
+		t, ok, err := relativeTime(c.Expression, now)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			single.Expression = t.Format(time.RFC3339Nano)
+			single.ExprType = goql.TIME
+		}
+	}
+	sc := goql.NewConditions()
+	sc.Add(&single)
+	return sc.CheckMap(map[string]interface{}{c.Key: v})
+}
+
+// validateCondition checks the parts of a condition that goql doesn't
+// know, so a mistake is reported when the filter is parsed instead of
+// dropping every item.
+func validateCondition(c *goql.Condition) error {
+	key := c.Key
+	if c.Operator == opHasWord && len(textWords(c.Expression)) == 0 {
+		return fmt.Errorf("has word expects a word, got: %s", exprString(c.ExprType, c.Expression))
+	}
+	if err := validateKey(key); err != nil || funcCall.MatchString(key) {
+		return err
+	}
+	if strings.EqualFold(key, "age") {
+		if c.Operator == goql.OP_RX || c.Operator == goql.OP_RXN || !isGoqlOperator(c.Operator) {
+			return fmt.Errorf("operator unsupported for durations: %s", operators[c.Operator])
+		}
+		_, err := parseDuration(c.Expression)
+		return err
+	}
+	if isDate(key) && isGoqlOperator(c.Operator) {
+		_, ok, err := relativeTime(c.Expression, time.Now())
+		if err != nil || ok {
+			return err
+		}
+		// goql compares any other value as a string with the date, the
+		// result would be wrong without an error
+		if c.ExprType != goql.TIME {
+			return fmt.Errorf("dates are compared with a time in single quotes like '2024-01-01T00:00:00Z' or with now-2d, got: %s", exprString(c.ExprType, c.Expression))
+		}
+		if _, err := time.Parse(time.RFC3339, c.Expression); err != nil {
+			return fmt.Errorf("invalid time, expected RFC 3339 like '2024-01-01T00:00:00Z', got: %s", exprString(c.ExprType, c.Expression))
+		}
+	}
+	return nil
+}
+
+// validateKey checks the functions and their arguments, which may be a
+// call themselves, e.g. len(stripHTML(Content)), and the fields of the
+// feed. Fields of the item are not checked, like goql an unknown field is
+// an error when the item is checked.
+func validateKey(key string) error {
+	m := funcCall.FindStringSubmatch(key)
+	if m == nil {
+		if name, ok := feedField(key); ok {
+			if _, ok := reflect.TypeOf(gofeed.Feed{}).FieldByName(name); !ok || name == "Items" {
+				return fmt.Errorf("unknown feed field: %s", name)
+			}
+		}
+		return nil
+	}
+	switch strings.ToLower(m[1]) {
+	case "weekday", "hour":
+		if !isDate(m[2]) {
+			return fmt.Errorf("%s expects a date, got %s", m[1], m[2])
+		}
+		return nil
+	case "lower", "len", "striphtml":
+		return validateKey(m[2])
+	}
+	if _, ok := normalizers[strings.ToLower(m[1])]; ok {
+		return validateKey(m[2])
+	}
+	return fmt.Errorf("unknown function: %s", m[1])
+}
+
+// isDate reports whether the field of the item or the feed is a date.
+func isDate(key string) bool {
+	t := reflect.TypeOf(gofeed.Item{})
+	if name, ok := feedField(key); ok {
+		t, key = reflect.TypeOf(gofeed.Feed{}), name
+	}
+	f, ok := t.FieldByName(key)
+	return ok && (f.Type == reflect.TypeOf(time.Time{}) || f.Type == reflect.TypeOf(&time.Time{}))
+}
+
+var funcCall = regexp.MustCompile(`^(\w+)\((.+)\)$`)
+
+// feedField returns the name of the field of a key like feed.Title, ok is
+// false if the key is not a field of the feed.
+func feedField(key string) (name string, ok bool) {
+	if len(key) > 5 && strings.EqualFold(key[:5], "feed.") {
+		return key[5:], true
+	}
+	return "", false
+}
+
+// itemValue returns the value of a field of the item, of a field of the
+// feed like feed.Title, of the pseudo field Age or of a function like
+// weekday(PublishedParsed) or lower(Title).
+func itemValue(feed *gofeed.Feed, item *gofeed.Item, key string, now time.Time) (interface{}, error) {
+	if strings.EqualFold(key, "age") {
+		t := item.PublishedParsed
+		if t == nil {
+			t = item.UpdatedParsed
+		}
+		if t == nil {
+			return nil, errors.New("item has no date")
+		}
+		return now.Sub(*t), nil
+	}
+
+	if m := funcCall.FindStringSubmatch(key); m != nil {
+		v, err := itemValue(feed, item, m[2], now)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(m[1]) {
+		case "lower":
+			return strings.ToLower(valueString(v)), nil
+		case "len":
+			if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Map {
+				return rv.Len(), nil
+			}
+			return utf8.RuneCountInString(valueString(v)), nil
+		case "striphtml":
+			return stripHTML(valueString(v)), nil
+		}
+		if f, ok := normalizers[strings.ToLower(m[1])]; ok {
+			return f(valueString(v)), nil
+		}
+		t, ok := v.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a date, got %s", m[1], m[2])
+		}
+		t = t.In(time.Local)
+		switch strings.ToLower(m[1]) {
+		case "weekday":
+			return t.Weekday().String(), nil
+		case "hour":
+			return t.Hour(), nil
+		}
+		return nil, fmt.Errorf("unknown function: %s", m[1])
+	}
+
+	st, field := reflect.ValueOf(item).Elem(), key
+	if name, ok := feedField(key); ok {
+		if feed == nil {
+			return nil, fmt.Errorf("no feed: %s", key)
+		}
+		st, field = reflect.ValueOf(feed).Elem(), name
+	}
+	fv := st.FieldByName(field)
+	if !fv.IsValid() {
+		return nil, fmt.Errorf("key not found: %s", key)
+	}
+	if fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return nil, fmt.Errorf("no value: %s", key)
+		}
+		fv = fv.Elem()
+	}
+	switch v := fv.Interface().(type) {
+	case string:
+		return norm.NFC.String(v), nil
+	case []string:
+		nfc := make([]string, len(v))
+		for i, s := range v {
+			nfc[i] = norm.NFC.String(s)
+		}
+		return nfc, nil
+	}
+	return fv.Interface(), nil
+}
+
+// relativeTime parses expressions like now, now-48h or now+1d, ok is false
+// if s is not relative to now.
+func relativeTime(s string, now time.Time) (t time.Time, ok bool, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !strings.HasPrefix(s, "now") {
+		return t, false, nil
+	}
+	rest := strings.TrimPrefix(s, "now")
+	if rest == "" {
+		return now, true, nil
+	}
+	if rest[0] != '-' && rest[0] != '+' {
+		return t, false, nil
+	}
+	d, err := parseDuration(rest[1:])
+	if err != nil {
+		return t, false, err
+	}
+	if rest[0] == '-' {
+		d = -d
+	}
+	return now.Add(d), true, nil
+}
+
+var longUnits = regexp.MustCompile(`(\d+(?:\.\d+)?)([dw])`)
+
+// parseDuration is time.ParseDuration with days (d) and weeks (w).
+func parseDuration(s string) (time.Duration, error) {
+	var err error
+	hours := longUnits.ReplaceAllStringFunc(s, func(p string) string {
+		n, e := strconv.ParseFloat(p[:len(p)-1], 64)
+		if e != nil {
+			err = e
+		}
+		if p[len(p)-1] == 'w' {
+			n *= 7
+		}
+		return strconv.FormatFloat(n*24, 'f', -1, 64) + "h"
+	})
+	if err != nil {
+		return 0, err
+	}
+	d, err := time.ParseDuration(hours)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return d, nil
+}
+
+func compareDuration(c *goql.Condition, d time.Duration) (bool, error) {
+	e, err := parseDuration(c.Expression)
+	if err != nil {
+		return false, err
+	}
+	switch c.Operator {
+	case goql.OP_EQ, goql.OP_EQI:
+		return d == e, nil
+	case goql.OP_NEQ, goql.OP_NEQI:
+		return d != e, nil
+	case goql.OP_GT:
+		return d > e, nil
+	case goql.OP_GE:
+		return d >= e, nil
+	case goql.OP_LT:
+		return d < e, nil
+	case goql.OP_LE:
+		return d <= e, nil
+	}
+	return false, fmt.Errorf("operator unsupported for durations: %s", operators[c.Operator])
+}
+
+func isRegex(op goql.Token) bool {
+	return op == goql.OP_RX || op == goql.OP_RXN || op == opRXI || op == opRXIN
+}
+
+// isGoqlOperator reports whether goql knows the operator.
+func isGoqlOperator(op goql.Token) bool {
+	return op >= goql.OP_EQI && op <= goql.OP_LE
+}
+
+// compareString evaluates the operators the filter language adds to goql.
+// Like ==, in ignores the case.
+func compareString(c *goql.Condition, s string) (bool, error) {
+	switch c.Operator {
+	case opContains:
+		return strings.Contains(s, c.Expression), nil
+	case opIContains:
+		return strings.Contains(strings.ToLower(s), strings.ToLower(c.Expression)), nil
+	case opStartsWith:
+		return strings.HasPrefix(s, c.Expression), nil
+	case opEndsWith:
+		return strings.HasSuffix(s, c.Expression), nil
+	case opIn:
+		values, err := parseList(c.Expression)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range values {
+			if strings.EqualFold(s, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case opHasWord:
+		return hasWord(s, c.Expression), nil
+	case opRXI, opRXIN:
+		rx, err := regexp.Compile("(?i)" + c.Expression)
+		if err != nil {
+			return false, err
+		}
+		return rx.MatchString(s) == (c.Operator == opRXI), nil
+	}
+	return false, fmt.Errorf("unsupported operator: %s", operators[c.Operator])
+}
+
+// normalizeList normalizes the values of a list in the filter syntax.
+func normalizeList(list string, normalize func(string) string) string {
+	values, err := parseList(list)
+	if err != nil {
+		return list
+	}
+	for i, v := range values {
+		values[i] = exprString(goql.LITERAL, normalize(v))
+	}
+	return "(" + strings.Join(values, ", ") + ")"
+}
+
+// compareList evaluates the operators the filter language adds to goql for
+// a list like the categories, the list matches if any of its values does,
+// and ~i! if none does.
+func compareList(c *goql.Condition, list []string) (bool, error) {
+	single := *c
+	if c.Operator == opRXIN {
+		single.Operator = opRXI
+	}
+	for _, s := range list {
+		m, err := compareString(&single, s)
+		if err != nil {
+			return false, err
+		}
+		if m {
+			return c.Operator != opRXIN, nil
+		}
+	}
+	return c.Operator == opRXIN, nil
+}
+
+// valueString returns the value as the string the string operators and
+// functions work on.
+func valueString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case time.Time:
+		return x.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+// blocks are the elements stripHTML replaces by a space.
+var blocks = map[string]bool{
+	"br": true, "p": true, "div": true, "li": true, "tr": true, "td": true, "th": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "blockquote": true,
+}
+
+// stripHTML returns the text of an HTML fragment with entities decoded and
+// whitespace collapsed, scripts and styles are dropped.
+func stripHTML(s string) string {
+	sb := strings.Builder{}
+	z := html.NewTokenizer(strings.NewReader(s))
+	skip := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(sb.String()), " ")
+		case html.TextToken:
+			if !skip {
+				sb.Write(z.Text())
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch tag := string(name); {
+			case tag == "script" || tag == "style":
+				skip = tt == html.StartTagToken
+			case blocks[tag]:
+				sb.WriteByte(' ')
+			}
+		}
+	}
+}
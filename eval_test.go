@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/rverst/goql"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"48h", 48 * time.Hour, false},
+		{"2d", 48 * time.Hour, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"1d12h30m", 36*time.Hour + 30*time.Minute, false},
+		{"1.5d", 36 * time.Hour, false},
+		{"500ms", 500 * time.Millisecond, false},
+		{"2", 0, true},
+		{"2x", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		d, err := parseDuration(tt.s)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", tt.s, d)
+			}
+			continue
+		}
+		if err != nil || d != tt.want {
+			t.Errorf("%s: got %s, %v, want %s", tt.s, d, err, tt.want)
+		}
+	}
+}
+
+func TestRelativeDates(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	pub := now.Add(-10 * time.Hour)
+	item := &gofeed.Item{Title: "now-playing", PublishedParsed: &pub}
+	local := pub.In(time.Local)
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`PublishedParsed > now-48h`, true},
+		{`PublishedParsed > now-5h`, false},
+		{`PublishedParsed < 'now'`, true},
+		{`PublishedParsed >= now-1d & PublishedParsed < now+1w`, true},
+		{`PublishedParsed > '2026-10-17T00:00:00Z'`, true},
+		{`age < 2d`, true},
+		{`Age >= 1d`, false},
+		{`age > 9h & age <= 10h`, true},
+		{`weekday(PublishedParsed) == "` + local.Weekday().String() + `"`, true},
+		{`weekday(PublishedParsed) == "` + local.Add(24*time.Hour).Weekday().String() + `"`, false},
+		{`hour(PublishedParsed) == ` + strconv.Itoa(local.Hour()), true},
+		{`hour(PublishedParsed) < ` + strconv.Itoa(local.Hour()), false},
+		{`Title == now-playing`, true},
+	}
+	for _, tt := range tests {
+		c, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		got, err := checkItem(c, nil, item, now)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %t, %v, want %t", tt.filter, got, err, tt.want)
+		}
+	}
+
+	if _, err := checkItem(mustParseFilter(t, `age < 1d`), nil, &gofeed.Item{}, now); err == nil {
+		t.Error("age of an item without date: expected an error")
+	}
+}
+
+func TestValidateCondition(t *testing.T) {
+	for _, filter := range []string{
+		`year(PublishedParsed) == 2026`,
+		`hour(Title) == 1`,
+		`age < 2x`,
+		`age ~= "1d"`,
+		`PublishedParsed > now-2x`,
+		`Title == "a" | UpdatedParsed < now+`,
+		`PublishedParsed > "2024-01-01T00:00:00Z"`,
+		`UpdatedParsed <= 2024`,
+		`feed.UpdatedParsed == "yesterday"`,
+		`PublishedParsed > '2024-01-01'`,
+	} {
+		if _, err := parseFilter(filter); err == nil {
+			t.Errorf("%s: expected an error", filter)
+		}
+	}
+}
+
+func mustParseFilter(t *testing.T, filter string) goql.Conditions {
+	t.Helper()
+	c, err := parseFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
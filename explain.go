@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	encjson "encoding/json"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/rverst/goql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// explanation tells for every item of a feed whether it passed the filter
+// and why.
+type explanation struct {
+	FeedUrl    string            `json:"feed_url,omitempty"`
+	Filter     string            `json:"filter"`
+	Conditions []string          `json:"conditions"`
+	Warnings   []string          `json:"warnings,omitempty"`
+	Rules      []string          `json:"rules,omitempty"`
+	ScoreRules []string          `json:"score_rules,omitempty"`
+	Threshold  *float64          `json:"threshold,omitempty"`
+	ItemsIn    int               `json:"items_in"`
+	ItemsKept  int               `json:"items_kept"`
+	Items      []itemExplanation `json:"items"`
+}
+
+type itemExplanation struct {
+	Title      string             `json:"title"`
+	Link       string             `json:"link,omitempty"`
+	GUID       string             `json:"guid,omitempty"`
+	Kept       bool               `json:"kept"`
+	DecidedBy  string             `json:"decided_by,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Conditions []conditionResult  `json:"conditions,omitempty"`
+	Rules      []filterRuleResult `json:"rules,omitempty"`
+	Score      *float64           `json:"score,omitempty"`
+	ScoreRules []scoreRuleResult  `json:"score_rules,omitempty"`
+}
+
+// conditionResult is a single evaluated condition, Matched is the result
+// of the comparison and Result the value after a negation. Decisive is
+// false if the condition didn't change the outcome, e.g. an AND after a
+// false condition.
+type conditionResult struct {
+	Condition string      `json:"condition"`
+	Value     interface{} `json:"value"`
+	Matched   bool        `json:"matched"`
+	Result    bool        `json:"result"`
+	Decisive  bool        `json:"decisive"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// filterRuleResult is a filter rule evaluated for an item, Applied tells
+// whether the item matched its if part and Matched whether it met its then
+// part.
+type filterRuleResult struct {
+	Rule    string `json:"rule"`
+	Applied bool   `json:"applied"`
+	Matched bool   `json:"matched"`
+	Error   string `json:"error,omitempty"`
+}
+
+// scoreRuleResult is a score rule evaluated for an item.
+type scoreRuleResult struct {
+	Rule    string  `json:"rule"`
+	Weight  float64 `json:"weight"`
+	Matched bool    `json:"matched"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// explainFeed evaluates the conditions for every item of the feed. The
+// conditions are evaluated one at a time and combined from left to right
+// like checkItem does, so the outcome is the same as in matchItems.
+// If there are filter or score rules, they are explained too.
+func explainFeed(feed *gofeed.Feed, t goql.Conditions, fr filterRules, sc *scoring) *explanation {
+	e := &explanation{Conditions: []string{}, Items: []itemExplanation{}}
+	var conditions []*goql.Condition
+	if t != nil {
+		conditions = t.Conditions()
+	}
+	for i, c := range conditions {
+		e.Conditions = append(e.Conditions, conditionString(c))
+		if i == 0 && c.Negate {
+			e.Warnings = append(e.Warnings, fmt.Sprintf("'not' is ignored for the first condition: %s", conditionString(c)))
+		}
+	}
+	for _, r := range fr {
+		e.Rules = append(e.Rules, r.rule)
+	}
+	if sc != nil {
+		for _, r := range sc.rules {
+			e.ScoreRules = append(e.ScoreRules, r.rule+" => "+strconv.FormatFloat(r.weight, 'f', -1, 64))
+		}
+		e.Threshold = &sc.threshold
+	}
+
+	now := time.Now()
+	for _, item := range feed.Items {
+		if item == nil {
+			continue
+		}
+		ie := explainItem(feed, item, conditions, now)
+		explainRules(&ie, feed, item, fr, now)
+		if sc != nil {
+			explainScore(&ie, feed, item, sc, now)
+		}
+		e.ItemsIn++
+		if ie.Kept {
+			e.ItemsKept++
+		}
+		e.Items = append(e.Items, ie)
+	}
+	return e
+}
+
+func explainItem(feed *gofeed.Feed, item *gofeed.Item, conditions []*goql.Condition, now time.Time) itemExplanation {
+	ie := itemExplanation{Title: item.Title, Link: item.Link, GUID: item.GUID, Kept: true}
+	if len(conditions) == 0 {
+		return ie
+	}
+
+	r := false
+	for _, c := range conditions {
+		cr := conditionResult{Condition: conditionString(c), Value: fieldValue(feed, item, c.Key, now)}
+		m, err := evalCondition(c, feed, item, now)
+		if err != nil {
+			// the evaluation stops at the first error and drops the item
+			cr.Error = err.Error()
+			cr.Decisive = true
+			ie.Conditions = append(ie.Conditions, cr)
+			ie.Kept = false
+			ie.DecidedBy = cr.Condition
+			ie.Error = err.Error()
+			return ie
+		}
+		cr.Matched = m
+		cr.Result = m
+		switch c.Link {
+		case goql.LNK_AND:
+			if c.Negate {
+				cr.Result = !m
+			}
+			cr.Decisive = r
+			r = r && cr.Result
+		case goql.LNK_OR:
+			if c.Negate {
+				cr.Result = !m
+			}
+			cr.Decisive = !r
+			r = r || cr.Result
+		default:
+			cr.Decisive = true
+			r = m
+		}
+		if cr.Decisive {
+			ie.DecidedBy = cr.Condition
+		}
+		ie.Conditions = append(ie.Conditions, cr)
+	}
+	ie.Kept = r
+	return ie
+}
+
+// explainRules adds the filter rules to the explanation of the item, an
+// item that passed the filter is dropped by the first rule it doesn't meet.
+func explainRules(ie *itemExplanation, feed *gofeed.Feed, item *gofeed.Item, fr filterRules, now time.Time) {
+	for _, r := range fr {
+		rr := filterRuleResult{Rule: r.rule}
+		m, err := checkItem(r.when, feed, item, now)
+		if err == nil && m {
+			rr.Applied = true
+			rr.Matched, err = checkItem(r.then, feed, item, now)
+		}
+		if err != nil {
+			rr.Error = err.Error()
+		}
+		ie.Rules = append(ie.Rules, rr)
+		if ie.Kept && (err != nil || (rr.Applied && !rr.Matched)) {
+			ie.Kept = false
+			ie.DecidedBy = r.rule
+			ie.Error = rr.Error
+		}
+	}
+}
+
+// explainScore adds the score of the item to its explanation, an item that
+// passed the filter is dropped if the score is not above the threshold.
+func explainScore(ie *itemExplanation, feed *gofeed.Feed, item *gofeed.Item, sc *scoring, now time.Time) {
+	var score float64
+	for _, r := range sc.rules {
+		rr := scoreRuleResult{Rule: r.rule, Weight: r.weight}
+		m, err := checkItem(r.conditions, feed, item, now)
+		if err != nil {
+			rr.Error = err.Error()
+		}
+		if m {
+			rr.Matched = true
+			score += r.weight
+		}
+		ie.ScoreRules = append(ie.ScoreRules, rr)
+	}
+	ie.Score = &score
+	if ie.Kept && score <= sc.threshold {
+		ie.Kept = false
+		ie.DecidedBy = fmt.Sprintf("score %g is not above the threshold %g", score, sc.threshold)
+	}
+}
+
+// marshal encodes the explanation as indented JSON, without escaping the
+// operators of the filter.
+func (e *explanation) marshal() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := encjson.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// conditionString formats a condition in the filter syntax.
+func conditionString(c *goql.Condition) string {
+	sb := strings.Builder{}
+	switch c.Link {
+	case goql.LNK_AND:
+		sb.WriteString("& ")
+	case goql.LNK_OR:
+		sb.WriteString("| ")
+	}
+	if c.Negate {
+		sb.WriteString("not ")
+	}
+	sb.WriteString(c.Key + " " + operators[c.Operator] + " ")
+	sb.WriteString(exprString(c.ExprType, c.Expression))
+	return sb.String()
+}
+
+var operators = map[goql.Token]string{
+	goql.OP_EQI:  "==",
+	goql.OP_EQ:   "===",
+	goql.OP_NEQI: "!=",
+	goql.OP_NEQ:  "!==",
+	goql.OP_RX:   "~=",
+	goql.OP_RXN:  "~!",
+	goql.OP_GT:   ">",
+	goql.OP_GE:   ">=",
+	goql.OP_LT:   "<",
+	goql.OP_LE:   "<=",
+	opRXI:        "~i=",
+	opRXIN:       "~i!",
+	opContains:   "contains",
+	opIContains:  "icontains",
+	opStartsWith: "startswith",
+	opEndsWith:   "endswith",
+	opIn:         "in",
+	opHasWord:    "has word",
+}
+
+// fieldValue returns the value of the item the condition is evaluated
+// against, or nil if there is no such value.
+func fieldValue(feed *gofeed.Feed, item *gofeed.Item, key string, now time.Time) interface{} {
+	v, err := itemValue(feed, item, key, now)
+	if err != nil {
+		return nil
+	}
+	switch x := v.(type) {
+	case time.Time:
+		return x.Format(time.RFC3339)
+	case time.Duration:
+		return x.String()
+	}
+	return v
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	encjson "encoding/json"
+	"github.com/mmcdole/gofeed"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestExplainMatchesFilter(t *testing.T) {
+	filters := []string{
+		``,
+		`Title ~= "^Breaking"`,
+		`Title ~= "Bonn" & Title ~! "^Sports"`,
+		`Title ~= "bridge" | Title ~= "cathedral"`,
+		`not Title ~= "Bonn" & GUID == "sports-1"`,
+		`Title ~= "Bonn" & not Link ~= "sports"`,
+		`Title ~= "x" | not Title ~= "Bonn"`,
+		`Title ~= "Bonn" | PublishedParsed > '2006-01-02T00:00:00Z'`,
+		`Title ~= "(" | Title ~= "Bonn"`,
+		`Unknown == "a"`,
+	}
+	for _, fixture := range fixtures {
+		feed, err := parseFeed(readFixture(t, filepath.Join("feeds", fixture)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, filter := range filters {
+			c, err := parseFilter(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept := map[*gofeed.Item]bool{}
+			for _, item := range matchItems(feed, c, nil) {
+				kept[item] = true
+			}
+			e := explainFeed(feed, c, nil, nil)
+			for i, ie := range e.Items {
+				if ie.Kept != kept[feed.Items[i]] {
+					t.Errorf("%s %s: item %q kept = %t, filter disagrees", fixture, filter, ie.Title, ie.Kept)
+				}
+			}
+		}
+	}
+}
+
+func TestExplainItem(t *testing.T) {
+	feed, err := parseFeed(readFixture(t, "feeds/rss20.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseFilter(`Title ~= "Bonn" & Title ~! "^Sports" | GUID == "x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := explainFeed(feed, c, nil, nil)
+	if e.ItemsIn != 3 || e.ItemsKept != 1 {
+		t.Errorf("items in %d, kept %d", e.ItemsIn, e.ItemsKept)
+	}
+
+	// Breaking: Cologne cathedral closed, the AND is irrelevant after the
+	// first condition failed, the OR decides
+	ie := e.Items[1]
+	if ie.Kept || ie.DecidedBy != `| GUID == "x"` {
+		t.Errorf("kept %t, decided by %s", ie.Kept, ie.DecidedBy)
+	}
+	if len(ie.Conditions) != 3 || ie.Conditions[1].Decisive || !ie.Conditions[1].Matched || ie.Conditions[0].Value != ie.Title {
+		t.Errorf("conditions %+v", ie.Conditions)
+	}
+
+	c, err = parseFilter(`Title ~= "Bonn" | Unknown == "a"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ie = explainFeed(feed, c, nil, nil).Items[0]
+	if ie.Kept || ie.Error != "key not found: Unknown" || ie.DecidedBy != `| Unknown == "a"` {
+		t.Errorf("kept %t, error %q, decided by %s", ie.Kept, ie.Error, ie.DecidedBy)
+	}
+
+	c, err = parseFilter(`Title ~= "Cologne" | PublishedParsed > '2006-01-03T12:00:00Z'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = explainFeed(feed, c, nil, nil)
+	if ie := e.Items[2]; !ie.Kept || ie.Conditions[1].Value != "2006-01-04T17:00:00Z" {
+		t.Errorf("kept %t, conditions %+v", ie.Kept, ie.Conditions)
+	}
+}
+
+func TestServeExplain(t *testing.T) {
+	upstream, h := newTestServer(t)
+	rec := requestPath(t, h, "/explain", url.Values{"feed_url": {upstream.URL + "/atom10.xml"}, "filter": {`not Title ~= "^Breaking"`}})
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var e explanation
+	if err := encjson.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ItemsIn != 3 || e.ItemsKept != 1 || len(e.Warnings) != 1 || e.Conditions[0] != `not Title ~= "^Breaking"` {
+		t.Errorf("unexpected explanation: %s", rec.Body.String())
+	}
+
+	rec = requestPath(t, h, "/explain", url.Values{"feed_url": {upstream.URL + "/atom10.xml"}, "filter": {`Title "x"`}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid filter: status %d", rec.Code)
+	}
+	rec = requestPath(t, h, "/explain", url.Values{"feed_url": {upstream.URL + "/missing.xml"}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing feed: status %d", rec.Code)
+	}
+}
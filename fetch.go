@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetries    = 3
+	defaultBackoff    = 500 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// upstreamError is returned when the upstream server answers with a
+// non 2xx status code.
+type upstreamError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream returned %s", e.Status)
+}
+
+// parseError is returned when the upstream response can't be parsed as a feed.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("can't parse feed: %s", e.err.Error())
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// upstream is a successfully fetched and parsed upstream feed.
+type upstream struct {
+	feed   *gofeed.Feed
+	status int
+	header http.Header
+	body   []byte
+}
+
+// fetcher retrieves and parses upstream feeds. Transient failures are
+// retried with exponential backoff and jitter.
+type fetcher struct {
+	client     *http.Client
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newFetcher(retries int) *fetcher {
+	return &fetcher{
+		client:     http.DefaultClient,
+		retries:    retries,
+		backoff:    defaultBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+}
+
+// fetch retrieves the feed at feedUrl, the credentials are forwarded with
+// basic authentication if either of them is set.
+func (f *fetcher) fetch(ctx context.Context, feedUrl, user, pass string) (*upstream, error) {
+	ctx, sp := startSpan(ctx, "fetch", spanKindInternal)
+	defer sp.finish()
+	sp.set("url.full", redactUrl(feedUrl))
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var up *upstream
+		var retryAfter time.Duration
+		up, retryAfter, err = f.fetchOnce(ctx, feedUrl, user, pass)
+		if err == nil {
+			sp.set("rss_filter.attempts", attempt+1)
+			return up, nil
+		}
+		if attempt >= f.retries || !isTransient(err) {
+			sp.set("rss_filter.attempts", attempt+1)
+			sp.fail(err)
+			return nil, err
+		}
+
+		// the upstream asks to wait longer than the max backoff, the
+		// retry would come too early
+		if retryAfter > f.maxBackoff {
+			sp.set("rss_filter.attempts", attempt+1)
+			sp.fail(err)
+			return nil, err
+		}
+		delay := f.delay(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		log.Ctx(ctx).Warn().Err(err).Str("feed_url", redactUrl(feedUrl)).Int("attempt", attempt+1).Dur("delay", delay).Msg("fetching of feed failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (f *fetcher) fetchOnce(ctx context.Context, feedUrl, user, pass string) (*upstream, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedUrl, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, sp := startSpan(ctx, "GET "+req.URL.Host, spanKindClient)
+	defer sp.finish()
+	sp.set("http.method", http.MethodGet)
+	sp.set("server.address", req.URL.Host)
+	if sp != nil {
+		req = req.WithContext(httptrace.WithClientTrace(ctx, clientTrace(sp)))
+	}
+	sp.inject(req.Header)
+
+	req.Header.Set("User-Agent", userAgent())
+	if user != "" || pass != "" {
+		req.SetBasicAuth(user, pass)
+	}
+
+	host := metricHost(ctx, req.URL.Host)
+	start := time.Now()
+	resp, err := f.client.Do(req)
+	if err != nil {
+		fetchDuration.observe(time.Since(start).Seconds(), host, "error")
+		sp.fail(err)
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	fetchDuration.observe(time.Since(start).Seconds(), host, strconv.Itoa(resp.StatusCode))
+	sp.set("http.status_code", resp.StatusCode)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Err(err).Send()
+		}
+		err = &upstreamError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       data,
+		}
+		sp.fail(err)
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")), err
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		sp.fail(err)
+		return nil, 0, err
+	}
+	sp.set("http.response.body.size", len(data))
+	sp.event("body read")
+
+	_, psp := startSpan(ctx, "parse", spanKindInternal)
+	feed, err := parseFeed(data)
+	if err != nil {
+		parseFailures.inc("feed")
+		err = &parseError{err: err}
+		psp.fail(err)
+		psp.finish()
+		return nil, 0, err
+	}
+	psp.set("rss_filter.feed_type", feed.FeedType)
+	psp.set("rss_filter.items", len(feed.Items))
+	psp.finish()
+	return &upstream{feed: feed, status: resp.StatusCode, header: resp.Header, body: data}, 0, nil
+}
+
+// clientTrace records the stages of an upstream request as events of
+// the span, so slow DNS lookups or connects can be told apart from slow
+// upstream servers.
+func clientTrace(sp *span) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn:              func(string) { sp.event("get connection") },
+		DNSStart:             func(httptrace.DNSStartInfo) { sp.event("dns start") },
+		DNSDone:              func(httptrace.DNSDoneInfo) { sp.event("dns done") },
+		ConnectStart:         func(string, string) { sp.event("connect start") },
+		ConnectDone:          func(string, string, error) { sp.event("connect done") },
+		TLSHandshakeStart:    func() { sp.event("tls start") },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { sp.event("tls done") },
+		GotConn:              func(httptrace.GotConnInfo) { sp.event("got connection") },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { sp.event("request written") },
+		GotFirstResponseByte: func() { sp.event("first response byte") },
+	}
+}
+
+// delay returns the backoff for the given attempt, it grows exponentially
+// and is randomized between half and the full value to avoid that several
+// clients retry in lockstep.
+func (f *fetcher) delay(attempt int) time.Duration {
+	d := f.backoff << uint(attempt)
+	if d <= 0 || d > f.maxBackoff {
+		d = f.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isTransient reports whether a failed fetch is worth retrying.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		switch ue.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var pe *parseError
+	if errors.As(err, &pe) {
+		return false
+	}
+	var de *net.DNSError
+	if errors.As(err, &de) {
+		return de.IsTimeout || de.IsTemporary
+	}
+	var oe *net.OpError
+	if errors.As(err, &oe) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&upstreamError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&upstreamError{StatusCode: http.StatusTooManyRequests}, true},
+		{&upstreamError{StatusCode: http.StatusGatewayTimeout}, true},
+		{&upstreamError{StatusCode: http.StatusNotFound}, false},
+		{&upstreamError{StatusCode: http.StatusUnauthorized}, false},
+		{&parseError{err: errors.New("no feed")}, false},
+		{context.Canceled, false},
+		{fmt.Errorf("get: %w", context.DeadlineExceeded), false},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{errors.New("unsupported protocol scheme"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("%v: got %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	f := newFetcher(3)
+	f.backoff, f.maxBackoff = 100*time.Millisecond, time.Second
+	for attempt, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := f.delay(attempt); d < max/2 || d > max {
+				t.Errorf("attempt %d: delay %s not between %s and %s", attempt, d, max/2, max)
+			}
+		}
+	}
+	if d := f.delay(100); d < f.maxBackoff/2 || d > f.maxBackoff {
+		t.Errorf("overflow: delay %s", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Errorf("seconds: got %s", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d < 58*time.Second || d > time.Minute {
+		t.Errorf("date: got %s", d)
+	}
+	for _, v := range []string{"", "-1", "soon"} {
+		if d := parseRetryAfter(v); d != 0 {
+			t.Errorf("%q: got %s", v, d)
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   []int
+		retries  int
+		wantErr  bool
+		attempts int32
+	}{
+		{"success", nil, 3, false, 1},
+		{"transient", []int{503, 502}, 3, false, 3},
+		{"too many failures", []int{503, 503, 503}, 2, true, 3},
+		{"not transient", []int{404}, 3, true, 1},
+		{"no retries", []int{503}, 0, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if n := int(attempts.Add(1)); n <= len(tt.status) {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(tt.status[n-1])
+					return
+				}
+				http.ServeFile(w, r, filepath.Join("testdata", "feeds", "rss20.xml"))
+			}))
+			defer upstream.Close()
+
+			f := newFetcher(tt.retries)
+			f.backoff, f.maxBackoff = time.Millisecond, 5*time.Millisecond
+			up, err := f.fetch(context.Background(), upstream.URL, "", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v", err)
+			}
+			if err == nil && len(up.feed.Items) != 3 {
+				t.Errorf("got %d items", len(up.feed.Items))
+			}
+			if n := attempts.Load(); n != tt.attempts {
+				t.Errorf("got %d attempts, want %d", n, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestFetchRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		maxBackoff time.Duration
+		wantErr    bool
+		attempts   int32
+		wait       time.Duration
+	}{
+		{"waits", "1", 2 * time.Second, false, 2, time.Second},
+		{"above max backoff", "1", 5 * time.Millisecond, true, 1, 0},
+		{"date above max backoff", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), time.Minute, true, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if attempts.Add(1) == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				http.ServeFile(w, r, filepath.Join("testdata", "feeds", "rss20.xml"))
+			}))
+			defer upstream.Close()
+
+			f := newFetcher(3)
+			f.backoff, f.maxBackoff = time.Millisecond, tt.maxBackoff
+			start := time.Now()
+			_, err := f.fetch(context.Background(), upstream.URL, "", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v", err)
+			}
+			if n := attempts.Load(); n != tt.attempts {
+				t.Errorf("got %d attempts, want %d", n, tt.attempts)
+			}
+			if d := time.Since(start); d < tt.wait {
+				t.Errorf("retried after %s, want %s", d, tt.wait)
+			}
+		})
+	}
+}
+
+func TestFetchCanceled(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	f := newFetcher(5)
+	f.backoff, f.maxBackoff = time.Hour, time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := f.fetch(ctx, upstream.URL, "", ""); err == nil {
+		t.Fatal("expected an error")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("backoff not canceled, took %s", d)
+	}
+}
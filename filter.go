@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rverst/goql"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Operators and expression types the filter language adds to goql. The
+// parser produces goql conditions, evalCondition handles these tokens
+// itself and leaves everything else to goql.
+const (
+	opContains goql.Token = iota + 100
+	opIContains
+	opStartsWith
+	opEndsWith
+	opIn
+	opRXI  // ~i= match case-insensitive regular expression
+	opRXIN // ~i! not match case-insensitive regular expression
+	opHasWord
+
+	// exprList is the expression type of the list of opIn, the expression
+	// holds the list in the filter syntax, e.g. ("a", "b")
+	exprList goql.Token = 200
+)
+
+// symbols are the operators written with symbols, longest first.
+var symbols = []struct {
+	s  string
+	op goql.Token
+}{
+	{"===", goql.OP_EQ}, {"!==", goql.OP_NEQ}, {"~i=", opRXI}, {"~i!", opRXIN},
+	{"==", goql.OP_EQI}, {"!=", goql.OP_NEQI}, {"~=", goql.OP_RX}, {"~!", goql.OP_RXN},
+	{">=", goql.OP_GE}, {"<=", goql.OP_LE}, {">", goql.OP_GT}, {"<", goql.OP_LT},
+}
+
+// words are the operators written as words, they are case-insensitive.
+var words = map[string]goql.Token{
+	"contains":   opContains,
+	"icontains":  opIContains,
+	"startswith": opStartsWith,
+	"endswith":   opEndsWith,
+	"in":         opIn,
+}
+
+var errIncomplete = errors.New("incomplete condition at the end of the filter")
+
+// filterParser parses the filter syntax of goql, extended by the word
+// operators like contains and has word, the case-insensitive regular
+// expressions and lists. Every
+// filter goql accepts is parsed to the same conditions, but unlike goql
+// an incomplete condition at the end is an error.
+type filterParser struct {
+	s   []rune
+	pos int
+}
+
+func newFilterParser(filter string) *filterParser {
+	return &filterParser{s: []rune(filter)}
+}
+
+func (p *filterParser) parse() (goql.Conditions, error) {
+	t, _, err := p.parseUntil("")
+	return t, err
+}
+
+// parseUntil parses the conditions up to the word stop, ok is false if the
+// filter ended before it.
+func (p *filterParser) parseUntil(stop string) (t goql.Conditions, ok bool, err error) {
+	t = goql.NewConditions()
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return t, false, nil
+		}
+		if w, n := p.peekWord(); stop != "" && strings.EqualFold(w, stop) {
+			p.pos += n
+			return t, true, nil
+		}
+		c, err := p.condition()
+		if err != nil {
+			return nil, false, err
+		}
+		t.Add(c)
+	}
+}
+
+// condition parses [& | |] [not] key operator expression, like goql
+// links and negations may be repeated.
+func (p *filterParser) condition() (*goql.Condition, error) {
+	c := &goql.Condition{}
+	for {
+		p.skipSpace()
+		if p.accept('&') {
+			c.Link = goql.LNK_AND
+		} else if p.accept('|') {
+			c.Link = goql.LNK_OR
+		} else if w, n := p.peekWord(); strings.EqualFold(w, "not") {
+			p.pos += n
+			c.Negate = true
+		} else {
+			break
+		}
+	}
+
+	var err error
+	if c.Key, err = p.key(); err != nil {
+		return nil, err
+	}
+	if c.Operator, err = p.operator(); err != nil {
+		return nil, err
+	}
+	if c.Operator == opIn {
+		c.ExprType = exprList
+		_, c.Expression, err = p.list()
+	} else {
+		c.ExprType, c.Expression, err = p.literal()
+	}
+	return c, err
+}
+
+func (p *filterParser) key() (string, error) {
+	p.skipSpace()
+	if p.eof() {
+		return "", errIncomplete
+	}
+	switch r := p.s[p.pos]; {
+	case r == '"' || r == '\'':
+		_, s, err := p.quoted()
+		if err == nil && s == "" {
+			err = errors.New("empty key")
+		}
+		return s, err
+	case strings.ContainsRune("=!~<>&|", r):
+		return "", fmt.Errorf("key expected, got: %c", r)
+	}
+	w, n := p.peekWord()
+	p.pos += n
+	return w, nil
+}
+
+func (p *filterParser) operator() (goql.Token, error) {
+	p.skipSpace()
+	if p.eof() {
+		return 0, errIncomplete
+	}
+	rest := string(p.s[p.pos:])
+	for _, o := range symbols {
+		if strings.HasPrefix(rest, o.s) {
+			p.pos += len([]rune(o.s))
+			return o.op, nil
+		}
+	}
+	w, n := p.peekWord()
+	if op, ok := words[strings.ToLower(w)]; ok {
+		p.pos += n
+		return op, nil
+	}
+	if strings.EqualFold(w, "has") {
+		p.pos += n
+		p.skipSpace()
+		if w, n := p.peekWord(); strings.EqualFold(w, "word") {
+			p.pos += n
+			return opHasWord, nil
+		}
+		return 0, errors.New("word expected after has")
+	}
+	if i := strings.IndexRune(w, '('); i > 0 && strings.EqualFold(w[:i], "in") {
+		// the list may follow without a space, e.g. in("a","b")
+		p.pos += i
+		return opIn, nil
+	}
+	return 0, fmt.Errorf("operator expected, got: %s", w)
+}
+
+// literal parses a quoted string, a time in single quotes or an unquoted
+// value that is typed like goql does.
+func (p *filterParser) literal() (goql.Token, string, error) {
+	p.skipSpace()
+	if p.eof() {
+		return 0, "", errIncomplete
+	}
+	if r := p.s[p.pos]; r == '"' || r == '\'' {
+		return p.quoted()
+	} else if r == '&' || r == '|' {
+		return 0, "", fmt.Errorf("expression expected, got: %c", r)
+	}
+	w, n := p.peekWord()
+	p.pos += n
+	return literalType(w), w, nil
+}
+
+// list parses a list of literals like ("a", "b"), it returns the values
+// and the list formatted in the filter syntax.
+func (p *filterParser) list() ([]string, string, error) {
+	p.skipSpace()
+	if p.eof() {
+		return nil, "", errIncomplete
+	}
+	if !p.accept('(') {
+		return nil, "", errors.New(`list expected after in, e.g. ("a", "b")`)
+	}
+	var values, formatted []string
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil, "", errors.New("unterminated list")
+		}
+		if len(values) == 0 && p.accept(')') {
+			return nil, "", errors.New("empty list")
+		}
+		var t goql.Token
+		var s string
+		if r := p.s[p.pos]; r == '"' || r == '\'' {
+			var err error
+			if t, s, err = p.quoted(); err != nil {
+				return nil, "", err
+			}
+		} else {
+			start := p.pos
+			for !p.eof() && !unicode.IsSpace(p.s[p.pos]) && p.s[p.pos] != ',' && p.s[p.pos] != ')' {
+				p.pos++
+			}
+			s = string(p.s[start:p.pos])
+			if s == "" {
+				return nil, "", fmt.Errorf("list value expected, got: %c", p.s[p.pos])
+			}
+			t = literalType(s)
+		}
+		values = append(values, s)
+		formatted = append(formatted, exprString(t, s))
+
+		p.skipSpace()
+		if p.accept(')') {
+			return values, "(" + strings.Join(formatted, ", ") + ")", nil
+		}
+		if !p.accept(',') {
+			return nil, "", errors.New("unterminated list")
+		}
+	}
+}
+
+// parseList returns the values of a list in the filter syntax.
+func parseList(s string) ([]string, error) {
+	values, _, err := newFilterParser(s).list()
+	return values, err
+}
+
+// quoted parses a string in double quotes or a time in single quotes,
+// only quotes and the backslash can be escaped.
+func (p *filterParser) quoted() (goql.Token, string, error) {
+	q := p.s[p.pos]
+	p.pos++
+	sb := strings.Builder{}
+	for ; !p.eof(); p.pos++ {
+		r := p.s[p.pos]
+		switch {
+		case r == q:
+			p.pos++
+			if q == '\'' {
+				return goql.TIME, sb.String(), nil
+			}
+			return goql.LITERAL, sb.String(), nil
+		case r == '\\':
+			p.pos++
+			if p.eof() || !strings.ContainsRune(`\"'`, p.s[p.pos]) {
+				return 0, "", fmt.Errorf("invalid escape in %s", string(q)+sb.String())
+			}
+			sb.WriteRune(p.s[p.pos])
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return 0, "", fmt.Errorf("unterminated string: %s", string(q)+sb.String())
+}
+
+// peekWord returns the next run of non-space characters and its length.
+func (p *filterParser) peekWord() (string, int) {
+	n := 0
+	for p.pos+n < len(p.s) && !unicode.IsSpace(p.s[p.pos+n]) {
+		n++
+	}
+	return string(p.s[p.pos : p.pos+n]), n
+}
+
+func (p *filterParser) accept(r rune) bool {
+	if !p.eof() && p.s[p.pos] == r {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *filterParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+// literalType types an unquoted value like goql: numbers are integers or
+// floats, true and false booleans, everything else a string.
+func literalType(s string) goql.Token {
+	num := s != ""
+	for i, r := range s {
+		if !unicode.IsDigit(r) && r != '.' && (i > 0 || r != '-') {
+			num = false
+		}
+	}
+	if num {
+		switch strings.Count(s, ".") {
+		case 0:
+			return goql.INTEGER
+		case 1:
+			return goql.FLOAT
+		}
+	}
+	if _, err := strconv.ParseBool(s); err == nil {
+		return goql.BOOLEAN
+	}
+	return goql.LITERAL
+}
+
+// exprString formats an expression in the filter syntax.
+func exprString(t goql.Token, s string) string {
+	switch t {
+	case goql.LITERAL:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	case goql.TIME:
+		return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + `'`
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+	"github.com/rverst/goql"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterParserGoqlCompatible(t *testing.T) {
+	for _, filter := range []string{
+		`Title ~= "^Breaking"`,
+		`not Title == "a" & not Link ~= "b" | GUID != "c"`,
+		`Title === "a \"b\" \\ c" | Title !== 'x\'y'`,
+		`PublishedParsed > '2006-01-02T15:04:05Z' & PublishedParsed <= now-2d`,
+		`Count >= 5 & Ratio < -1.5 & Flag == true & Title ~! a&b|c`,
+		`Title  ==   "a"   Link ~= b`,
+		`& | Title == "a"`,
+		`NOT Title == "a"`,
+	} {
+		want, err := goql.NewParser(strings.NewReader(filter)).Parse()
+		if err != nil {
+			t.Fatalf("%s: %v", filter, err)
+		}
+		got, err := newFilterParser(filter).parse()
+		if err != nil {
+			t.Errorf("%s: %v", filter, err)
+			continue
+		}
+		if !got.Equals(want) {
+			t.Errorf("%s: got %s, want %s", filter, got, want)
+		}
+	}
+}
+
+func TestFilterParser(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{`Title contains "Bonn"`, `Title contains "Bonn"`},
+		{`Title ICONTAINS bonn`, `Title icontains "bonn"`},
+		{`Link startswith "https://" & Link endswith .html`, `Link startswith "https://",& Link endswith ".html"`},
+		{`GUID in ("a", "b\"c",1)`, `GUID in ("a", "b\"c", 1)`},
+		{`not Title in( a , 'b' )`, `not Title in ("a", 'b')`},
+		{`Title ~i= "^bonn" | Title ~i! x`, `Title ~i= "^bonn",| Title ~i! "x"`},
+		{`len(stripHTML(Description)) > 100`, `len(stripHTML(Description)) > 100`},
+	}
+	for _, tt := range tests {
+		c, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		var got []string
+		for _, cond := range c.Conditions() {
+			got = append(got, conditionString(cond))
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.filter, strings.Join(got, ","), tt.want)
+		}
+	}
+
+	for _, filter := range []string{
+		`Title contains`,
+		`Title includes "a"`,
+		`Title in "a"`,
+		`Title in ()`,
+		`Title in ("a"`,
+		`Title in ("a" "b")`,
+		`Title == &`,
+		`Title ~= "a\n"`,
+		`upper(Title) == "A"`,
+		`len(weekday(Title)) == 6`,
+		`age contains "1d"`,
+	} {
+		if _, err := parseFilter(filter); err == nil {
+			t.Errorf("%s: expected an error", filter)
+		}
+	}
+}
+
+func TestStringOperators(t *testing.T) {
+	item := &gofeed.Item{
+		Title:       "Bonn opens new Bridge",
+		Link:        "https://example.com/bonn.html",
+		Description: "<p>The <b>new</b> bridge</p><p>opens&nbsp;today</p><script>var x = 1;</script>",
+		Categories:  []string{"local", "traffic"},
+	}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`Title contains "Bridge"`, true},
+		{`Title contains "bridge"`, false},
+		{`Title icontains "BRIDGE"`, true},
+		{`Link startswith "https://"`, true},
+		{`Link endswith ".xml"`, false},
+		{`Title in ("Cologne", "bonn opens new bridge")`, true},
+		{`Title in ("Cologne")`, false},
+		{`Title ~i= "^bonn.*bridge$"`, true},
+		{`Title ~i! "bridge"`, false},
+		{`Title ~= "^bonn"`, false},
+		{`lower(Title) === "bonn opens new bridge"`, true},
+		{`lower(Title) startswith "bonn"`, true},
+		{`len(Title) == 21`, true},
+		{`len(Categories) == 2`, true},
+		{`Categories contains "traf"`, true},
+		{`Categories in ("Traffic", "sports")`, true},
+		{`Categories startswith "sports"`, false},
+		{`Categories ~i! "^TRAFFIC$"`, false},
+		{`Categories ~i! "^sports$"`, true},
+		{`stripHTML(Description) === "The new bridge opens today"`, true},
+		{`len(stripHTML(Description)) < 30`, true},
+		{`Title contains "Bonn" & not Title startswith "Sports"`, true},
+	}
+	for _, tt := range tests {
+		c, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		got, err := checkItem(c, nil, item, time.Now())
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %t, %v, want %t", tt.filter, got, err, tt.want)
+		}
+	}
+
+	if _, err := checkItem(mustParseFilter(t, `Title ~i= "("`), nil, item, time.Now()); err == nil {
+		t.Error("invalid regular expression: expected an error")
+	}
+}
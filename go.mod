@@ -8,6 +8,10 @@ require (
 	github.com/mmcdole/gofeed v1.2.1
 	github.com/rs/zerolog v1.31.0
 	github.com/rverst/goql v0.0.2
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/crypto v0.18.0
+	golang.org/x/net v0.20.0
+	golang.org/x/text v0.14.0
 )
 
 require (
@@ -19,7 +23,5 @@ require (
 	github.com/mmcdole/goxpp v1.1.0 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
-	golang.org/x/net v0.20.0 // indirect
 	golang.org/x/sys v0.16.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 )
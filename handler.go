@@ -1,14 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/gorilla/feeds"
-	"github.com/mmcdole/gofeed"
 	"github.com/rs/zerolog/log"
-	"github.com/rverst/goql"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,14 +26,39 @@ type rssHandler struct {
 	user        string
 	password    string
 	disableAuth bool
+	fetcher     *fetcher
+	cache       *staleCache
+	scheduler   *scheduler
+	websub      *websub
+	timeout     time.Duration
+	baseUrl     string
+	mux         *http.ServeMux
 }
 
-func newRssHandler(user, password string, disableAuth bool) *rssHandler {
-	return &rssHandler{
+func newRssHandler(user, password string, disableAuth bool, fetcher *fetcher, cache *staleCache, scheduler *scheduler, websub *websub, timeout time.Duration, baseUrl string) *rssHandler {
+	h := &rssHandler{
 		user:        user,
 		password:    password,
 		disableAuth: disableAuth,
+		fetcher:     fetcher,
+		cache:       cache,
+		scheduler:   scheduler,
+		websub:      websub,
+		timeout:     timeout,
+		baseUrl:     strings.TrimSuffix(baseUrl, "/"),
+		mux:         http.NewServeMux(),
 	}
+	h.mux.HandleFunc("/metrics", serveMetrics)
+	h.mux.HandleFunc("/status", scheduler.serveStatus)
+	h.mux.HandleFunc("/feeds/", h.serveNamed)
+	h.mux.HandleFunc("/explain", h.serveExplain)
+	h.mux.HandleFunc("/opml", h.serveOPML)
+	h.mux.Handle("/ui/", uiHandler())
+	if websub != nil {
+		h.mux.HandleFunc("/websub/hub", websub.serveHub)
+	}
+	h.mux.HandleFunc("/", h.serveFilter)
+	return h
 }
 
 func (h rssHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +72,14 @@ func (h rssHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	h.mux.ServeHTTP(w, r)
+}
+
+// serveFilter fetches the feed given by the query parameters, filters
+// and returns it.
+func (h rssHandler) serveFilter(w http.ResponseWriter, r *http.Request) {
+
+	l := log.Ctx(r.Context())
 	var feedUrl, filter, output string
 
 	q := r.URL.Query()
@@ -59,174 +92,297 @@ func (h rssHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			output = strings.ToLower(v[0])
 		}
 	}
-	log.Trace().Str("feed_url", feedUrl).Str("filter", filter).Str("output", output).Msg("serve http")
+	l.Trace().Str("feed_url", redactUrl(feedUrl)).Str("filter", filter).Str("output", output).Msg("serve http")
+	ri := info(r)
+	ri.pipeline = "adhoc"
 
 	if feedUrl == "" {
-		log.Error().Msg("no feed provided")
+		l.Error().Msg("no feed provided")
 		w.WriteHeader(http.StatusBadRequest)
 		_, _ = w.Write([]byte("no feed url"))
 		return
 	}
 
-	var fm format
-	switch format(output) {
-	case rss:
-		fm = rss
-	case atom:
-		fm = atom
-	case json:
-		fm = json
-	default:
-		fm = keep
-	}
+	fm := parseFormat(output)
 
-	p := goql.NewParser(strings.NewReader(filter))
-	t, err := p.Parse()
+	t, err := parseFilter(filter)
 	if err != nil {
-		log.Err(err).Msg("parsing filter failed")
+		parseFailures.inc("filter")
+		l.Err(err).Msg("parsing filter failed")
 		w.WriteHeader(http.StatusBadRequest)
 		_, _ = w.Write([]byte(fmt.Sprintf("can't parse filter: %s", err.Error())))
 		return
 	}
 
-	req, err := http.NewRequest("GET", feedUrl, nil)
+	fr, err := queryFilterRules(r)
 	if err != nil {
-		log.Err(err).Msg("fetching of feed failed")
-		w.WriteHeader(http.StatusInternalServerError)
+		parseFailures.inc("rules")
+		l.Err(err).Msg("parsing rules failed")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("can't parse rules: %s", err.Error())))
+		return
+	}
+
+	sc, err := queryScoring(r)
+	if err != nil {
+		parseFailures.inc("score")
+		l.Err(err).Msg("parsing score rules failed")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("can't parse score: %s", err.Error())))
+		return
+	}
+
+	lo, err := queryListOptions(r)
+	if err != nil {
+		l.Err(err).Msg("parsing list options failed")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
 	}
 
-	req.Header.Set("User-Agent", userAgent())
 	fUser := r.Header.Get("x-forward-user")
 	fPass := r.Header.Get("x-forward-password")
-	if fUser != "" || fPass != "" {
-		req.SetBasicAuth(fUser, fPass)
+	key := staleKey(r.URL.Query(), fUser, fPass)
+
+	ctx := r.Context()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	up, err := h.fetcher.fetch(ctx, feedUrl, fUser, fPass)
+	if err != nil {
+		var pe *parseError
+		timedOut := r.Context().Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+		if (isTransient(err) || timedOut || errors.As(err, &pe)) && h.serveStale(w, r, key, err) {
+			return
+		}
+		h.fetchFailed(w, r, feedUrl, err, timedOut)
+		return
 	}
 
-	client := http.DefaultClient
-	resp, err := client.Do(req)
+	feed := up.feed
+	fm = resolveFormat(fm, feed)
+	_, sp := startSpan(r.Context(), "filter", spanKindInternal)
+	items := sc.keep(feed, matchItems(feed, t, fr))
+	page := lo.apply(items)
+	newFeed := buildFeed(feed, page)
+	sp.set("rss_filter.items_in", len(feed.Items))
+	sp.set("rss_filter.items_kept", len(items))
+	sp.finish()
+	ri.upstreamStatus = up.status
+	ri.itemsIn, ri.itemsKept = len(feed.Items), len(items)
+	countItems(ri.pipeline, ri.itemsIn, ri.itemsKept)
 
+	base := h.baseUrl
+	if base == "" {
+		base = requestBaseUrl(r)
+	}
+	var links []feedLink
+	if self, err := url.Parse(base + r.URL.RequestURI()); err == nil {
+		links = pagingLinks(self, len(items), lo)
+	}
+
+	_, sp = startSpan(r.Context(), "render", spanKindInternal)
+	body, cType, err := renderFeed(newFeed, sc.categories(feed, page), fm, links...)
+	sp.set("rss_filter.format", string(fm))
+	sp.set("rss_filter.bytes", len(body))
+	sp.fail(err)
+	sp.finish()
 	if err != nil {
-		log.Err(err).Msg("fetching of feed failed")
+		l.Err(err).Msg("creating of feed failed")
 		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(fmt.Sprintf("can't create feed: %#v", newFeed)))
+		return
 	}
+	l.Debug().Str("format", string(fm)).Int("original_items", len(feed.Items)).Int("kept_items", len(items)).Msg("feed filtered")
 
-	if resp != nil {
-		defer resp.Body.Close()
-	}
+	h.cache.put(key, []byte(body), cType)
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		log.Error().Int("status_code", resp.StatusCode).Str("status", resp.Status).Msg("http error")
+	w.Header().Set("Content-Type", cType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(body))
+}
 
-		w.WriteHeader(resp.StatusCode)
-		if data, err := ioutil.ReadAll(resp.Body); err != nil {
-			log.Err(err).Send()
-		} else {
-			_, _ = w.Write(data)
-		}
+// serveExplain fetches the feed given by the query parameters and returns
+// for every item whether it passed the filter and which condition decided
+// it, as JSON.
+func (h rssHandler) serveExplain(w http.ResponseWriter, r *http.Request) {
+	l := log.Ctx(r.Context())
+	feedUrl := queryValue(r, "feed_url")
+	filter := queryValue(r, "filter")
+	info(r).pipeline = "explain"
+
+	if feedUrl == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("no feed url"))
+		return
+	}
+	t, err := parseFilter(filter)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("can't parse filter: %s", err.Error())))
+		return
+	}
+	fr, err := queryFilterRules(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("can't parse rules: %s", err.Error())))
+		return
+	}
+	sc, err := queryScoring(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("can't parse score: %s", err.Error())))
+		return
+	}
+
+	ctx := r.Context()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	up, err := h.fetcher.fetch(ctx, feedUrl, r.Header.Get("x-forward-user"), r.Header.Get("x-forward-password"))
+	if err != nil {
+		h.fetchFailed(w, r, feedUrl, err, r.Context().Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded))
 		return
 	}
 
-	fp := gofeed.NewParser()
-	feed, err := fp.Parse(resp.Body)
+	e := explainFeed(up.feed, t, fr, sc)
+	e.FeedUrl = redactUrl(feedUrl)
+	e.Filter = filter
+	ri := info(r)
+	ri.upstreamStatus = up.status
+	ri.itemsIn, ri.itemsKept = e.ItemsIn, e.ItemsKept
+
+	data, err := e.marshal()
 	if err != nil {
-		log.Err(err).Msg("parsing of feed failed")
+		l.Err(err).Msg("encoding of explanation failed")
 		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf("can't parse feed: %s", feedUrl)))
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
 
-	if fm == keep {
-		switch format(strings.ToLower(feed.FeedType)) {
-		case rss:
-			fm = rss
-		case atom:
-			fm = atom
-		case json:
-			fm = json
-		default:
-			fm = atom
-		}
+// fetchFailed writes the response for a feed that couldn't be fetched.
+func (h rssHandler) fetchFailed(w http.ResponseWriter, r *http.Request, feedUrl string, err error, timedOut bool) {
+	l := log.Ctx(r.Context())
+	var ue *upstreamError
+	var pe *parseError
+	switch {
+	case timedOut:
+		l.Err(err).Dur("timeout", h.timeout).Msg("fetching of feed timed out")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		_, _ = w.Write([]byte(fmt.Sprintf("upstream timed out: %s", feedUrl)))
+	case errors.As(err, &ue):
+		info(r).upstreamStatus = ue.StatusCode
+		l.Error().Int("status_code", ue.StatusCode).Str("status", ue.Status).Msg("http error")
+		w.WriteHeader(ue.StatusCode)
+		_, _ = w.Write(ue.Body)
+	case errors.As(err, &pe):
+		l.Err(err).Msg("parsing of feed failed")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(fmt.Sprintf("can't parse feed: %s", feedUrl)))
+	default:
+		l.Err(err).Msg("fetching of feed failed")
+		w.WriteHeader(http.StatusInternalServerError)
 	}
+}
 
-	newFeed := feeds.Feed{
-		Title:       feed.Title,
-		Link:        &feeds.Link{Href: feed.Link},
-		Description: feed.Description,
-		Author: &feeds.Author{
-			Name: "https://github.com/rverst/rss-filter",
-		},
-		Updated:   *feed.UpdatedParsed,
-		Created:   *feed.PublishedParsed,
-		Items:     []*feeds.Item{},
-		Copyright: feed.Copyright,
+// serveNamed returns a named feed from the scheduler.
+func (h rssHandler) serveNamed(w http.ResponseWriter, r *http.Request) {
+	l := log.Ctx(r.Context())
+	name := strings.TrimPrefix(r.URL.Path, "/feeds/")
+	l.Trace().Str("feed", name).Msg("serve named feed")
+	if page := queryValue(r, "archive"); page != "" {
+		h.serveArchive(w, r, name, page)
+		return
 	}
 
-	for _, item := range feed.Items {
-		if item == nil {
-			continue
-		}
-		if len(t.Conditions()) > 0 {
-			b, err := t.CheckStruct(item)
-			if err != nil {
-				log.Warn().Err(err).Interface("item", item).Msg("check item failed")
-			}
-			if !b {
-				continue
-			}
-		}
+	st, ok := h.scheduler.get(r.Context(), name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(fmt.Sprintf("unknown feed: %s", name)))
+		return
+	}
+	info(r).pipeline = name
 
-		var pub, upd time.Time
-		var enc *feeds.Enclosure
-		if item.PublishedParsed != nil {
-			pub = *item.PublishedParsed
-		}
-		if item.UpdatedParsed != nil {
-			upd = *item.UpdatedParsed
-		}
+	age := time.Since(st.fetched)
+	if st.body == nil || (st.err != nil && age > h.cache.maxStale) {
+		l.Error().Err(st.err).Str("feed", name).Msg("no feed available")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(fmt.Sprintf("can't fetch feed: %s", name)))
+		return
+	}
 
-		if len(item.Enclosures) > 0 {
-			enc = new(feeds.Enclosure)
-			enc.Type = item.Enclosures[0].Type
-			enc.Url = item.Enclosures[0].URL
-			enc.Length = item.Enclosures[0].Length
-		}
+	w.Header().Set("Content-Type", st.contentType)
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	if h.websub != nil {
+		w.Header().Set("Link", h.websub.linkHeader(name))
+	}
+	if st.err != nil {
+		w.Header().Add("Warning", `110 - "Response is Stale"`)
+		w.Header().Add("Warning", `111 - "Revalidation Failed"`)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(st.body)
+}
+
+// serveArchive returns a page of the archive of a named feed.
+func (h rssHandler) serveArchive(w http.ResponseWriter, r *http.Request, name, page string) {
+	l := log.Ctx(r.Context())
+	n, err := strconv.ParseUint(page, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("invalid archive page: %s", page)))
+		return
+	}
+	if _, ok := h.scheduler.feed(name); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(fmt.Sprintf("unknown feed: %s", name)))
+		return
+	}
+	info(r).pipeline = name
 
-		newFeed.Items = append(newFeed.Items, &feeds.Item{
-			Title:       item.Title,
-			Link:        &feeds.Link{Href: item.Link},
-			Description: item.Description,
-			Id:          item.GUID,
-			Updated:     upd,
-			Created:     pub,
-			Content:     item.Content,
-			Enclosure:   enc,
-		})
-	}
-
-	var body string
-	var cType = "application/xml"
-	switch fm {
-	case rss:
-		body, err = newFeed.ToRss()
-	case atom:
-		body, err = newFeed.ToAtom()
-	case json:
-		body, err = newFeed.ToJSON()
-		cType = "application/json"
+	body, cType, err := h.scheduler.archive(r.Context(), name, n)
+	if errors.Is(err, errNoPage) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(fmt.Sprintf("no archive page %d of feed %s", n, name)))
+		return
 	}
 	if err != nil {
-		log.Err(err).Msg("creating of feed failed")
+		l.Err(err).Str("feed", name).Uint64("page", n).Msg("rendering of archive page failed")
 		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf("can't create feed: %#v", newFeed)))
 		return
 	}
-	log.Debug().Str("format", string(fm)).Int("original_items", len(feed.Items)).Int("kept_items", len(newFeed.Items)).Msg("feed filtered")
-
 	w.Header().Set("Content-Type", cType)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte(body))
 }
 
+// serveStale writes the last successfully filtered version of the feed
+// identified by key, if there is one that is not too old. It returns
+// false if nothing was written.
+func (h rssHandler) serveStale(w http.ResponseWriter, r *http.Request, key string, cause error) bool {
+	e, ok := h.cache.get(key)
+	if !ok {
+		return false
+	}
+	age := time.Since(e.stored)
+	log.Ctx(r.Context()).Warn().Err(cause).Dur("age", age).Msg("serving stale feed")
+
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Add("Warning", `110 - "Response is Stale"`)
+	w.Header().Add("Warning", `111 - "Revalidation Failed"`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(e.body)
+	return true
+}
+
 func userAgent() string {
 	return fmt.Sprintf("rss-filter/%s (%s; %s)", version, runtime.GOOS, runtime.GOARCH)
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"flag"
+	"github.com/mmcdole/gofeed"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+var fixtures = []string{"rss091.xml", "rss092.xml", "rss20.xml", "atom10.xml", "rdf.xml", "jsonfeed.json"}
+
+// newTestServer returns an upstream that serves the fixtures in
+// testdata/feeds and an rss-filter handler without authentication.
+func newTestServer(t *testing.T) (*httptest.Server, *rssHandler) {
+	t.Helper()
+	upstream := httptest.NewServer(http.FileServer(http.Dir(filepath.Join("testdata", "feeds"))))
+	t.Cleanup(upstream.Close)
+
+	f := newFetcher(0)
+	sched := newScheduler(f, nil, nil, defaultHostLimit, time.Second)
+	return upstream, newRssHandler("", "", true, f, newStaleCache(defaultMaxStale), sched, nil, 5*time.Second, "")
+}
+
+func request(t *testing.T, h http.Handler, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	return requestPath(t, h, "/", query)
+}
+
+func requestPath(t *testing.T, h http.Handler, path string, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?"+query.Encode(), nil))
+	return rec
+}
+
+func titles(t *testing.T, body string) []string {
+	t.Helper()
+	feed, err := gofeed.NewParser().ParseString(body)
+	if err != nil {
+		t.Fatalf("can't parse response: %v\n%s", err, body)
+	}
+	list := []string{}
+	for _, item := range feed.Items {
+		list = append(list, item.Title)
+	}
+	return list
+}
+
+func TestFilter(t *testing.T) {
+	upstream, h := newTestServer(t)
+	tests := []struct {
+		fixture string
+		filter  string
+		want    []string
+	}{
+		{"rss20.xml", ``, []string{"Bonn opens new bridge", "Breaking: Cologne cathedral closed", "Sports: Bonn wins"}},
+		{"rss20.xml", `Title ~= "^Breaking"`, []string{"Breaking: Cologne cathedral closed"}},
+		{"rss20.xml", `Title ~! "^Breaking"`, []string{"Bonn opens new bridge", "Sports: Bonn wins"}},
+		{"rss20.xml", `Title ~= "Bonn" & Title ~! "^Sports"`, []string{"Bonn opens new bridge"}},
+		{"rss20.xml", `Title ~= "bridge" | Title ~= "cathedral"`, []string{"Bonn opens new bridge", "Breaking: Cologne cathedral closed"}},
+		{"rss20.xml", `Link ~= "^https://news.example.org/"`, []string{"Bonn opens new bridge", "Breaking: Cologne cathedral closed"}},
+		{"rss20.xml", `GUID == "sports-1"`, []string{"Sports: Bonn wins"}},
+		{"rss20.xml", `Title == "Bonn"`, []string{}},
+		{"rss091.xml", `Title ~= "Bonn|Cologne"`, []string{"Sunny in Bonn", "Rain in Cologne"}},
+		{"rss092.xml", `Title ~= "Cologne"`, []string{"Episode 2: Cologne"}},
+		{"atom10.xml", `Title ~! "^Breaking"`, []string{"Release 1.0", "Release 1.0.1"}},
+		{"atom10.xml", `Description ~= "update"`, []string{"Breaking: Security advisory"}},
+		{"rdf.xml", `Title ~= "^Breaking"`, []string{"Breaking: New comet"}},
+		{"jsonfeed.json", `Title ~= "Kölsch"`, []string{"Breaking: Cologne Kölsch bread"}},
+		{"jsonfeed.json", `Title != "Bonn style potato salad"`, []string{"Breaking: Cologne Kölsch bread"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture+" "+tt.filter, func(t *testing.T) {
+			for _, out := range []string{"rss", "atom", "json"} {
+				rec := request(t, h, url.Values{"feed_url": {upstream.URL + "/" + tt.fixture}, "filter": {tt.filter}, "out": {out}})
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status %d: %s", out, rec.Code, rec.Body.String())
+				}
+				if got := titles(t, rec.Body.String()); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s: got %q, want %q", out, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGolden(t *testing.T) {
+	upstream, h := newTestServer(t)
+	for _, fixture := range fixtures {
+		for _, out := range []string{"keep", "rss", "atom", "json"} {
+			name := strings.TrimSuffix(fixture, filepath.Ext(fixture)) + "." + out
+			t.Run(name, func(t *testing.T) {
+				rec := request(t, h, url.Values{"feed_url": {upstream.URL + "/" + fixture}, "filter": {`Title ~! "^Breaking"`}, "out": {out}})
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+				}
+				got := rec.Header().Get("Content-Type") + "\n\n" + rec.Body.String()
+
+				golden := filepath.Join("testdata", "golden", name)
+				if *update {
+					if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != string(want) {
+					t.Errorf("output differs from %s, run the tests with -update if the change is intended\ngot:\n%s\nwant:\n%s", golden, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	upstream, h := newTestServer(t)
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"no feed url", url.Values{}, http.StatusBadRequest},
+		{"invalid filter", url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "filter": {`Title "Bonn"`}}, http.StatusBadRequest},
+		{"not found", url.Values{"feed_url": {upstream.URL + "/missing.xml"}}, http.StatusNotFound},
+		{"not a feed", url.Values{"feed_url": {upstream.URL + "/"}}, http.StatusInternalServerError},
+		{"unreachable", url.Values{"feed_url": {"http://127.0.0.1:1/feed.xml"}}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := request(t, h, tt.query)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuth(t *testing.T) {
+	upstream, _ := newTestServer(t)
+	f := newFetcher(0)
+	h := newRssHandler("user", "secret", false, f, newStaleCache(0), newScheduler(f, nil, nil, defaultHostLimit, 0), nil, 0, "")
+	target := "/?" + url.Values{"feed_url": {upstream.URL + "/rss20.xml"}}.Encode()
+
+	for _, tt := range []struct {
+		user, pass string
+		status     int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"user", "wrong", http.StatusUnauthorized},
+		{"user", "secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s:%s: status %d, want %d", tt.user, tt.pass, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter     string
+		conditions int
+		wantErr    bool
+	}{
+		{``, 0, false},
+		{`Title ~= "a"`, 1, false},
+		{`not Title == "a" & not Link ~= "b" | GUID != "c"`, 3, false},
+		{`PublishedParsed > '2006-01-02T15:04:05Z'`, 1, false},
+		{`Title`, 0, true},
+		{`Title ~=`, 0, true},
+		{`Title ~= "a" |`, 0, true},
+		{`Title ~= "a" | Link`, 0, true},
+		{`Title "a"`, 0, true},
+		{`Title ~= "a`, 0, true},
+	}
+	for _, tt := range tests {
+		c, err := parseFilter(tt.filter)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %d conditions", tt.filter, len(c.Conditions()))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		if len(c.Conditions()) != tt.conditions {
+			t.Errorf("%s: got %d conditions, want %d", tt.filter, len(c.Conditions()), tt.conditions)
+		}
+	}
+}
+
+func FuzzParseFilter(f *testing.F) {
+	for _, s := range []string{``, `Title ~= "^Breaking"`, `Title == "a" & Link ~! "b" | GUID != "c"`, `PublishedParsed > '2006-01-02T15:04:05Z'`} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, filter string) {
+		_, _ = parseFilter(filter)
+	})
+}
+
+func FuzzPipeline(f *testing.F) {
+	for _, fixture := range fixtures {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "feeds", fixture))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data, `Title ~! "^Breaking"`)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, filter string) {
+		feed, err := parseFeed(data)
+		if err != nil {
+			return
+		}
+		conditions, err := parseFilter(filter)
+		if err != nil {
+			return
+		}
+		newFeed, _ := filterFeed(feed, conditions, nil, nil, listOptions{})
+		for _, fm := range []format{rss, atom, json} {
+			_, _, _ = renderFeed(newFeed, nil, fm)
+		}
+	})
+}
+
+func TestUI(t *testing.T) {
+	_, h := newTestServer(t)
+	for _, path := range []string{"/ui/", "/ui/ui.js", "/ui/ui.css"} {
+		rec := requestPath(t, h, path, nil)
+		if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Errorf("%s: status %d", path, rec.Code)
+		}
+		if rec.Header().Get("Content-Security-Policy") == "" {
+			t.Errorf("%s: no content security policy", path)
+		}
+	}
+}
@@ -1,21 +1,65 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/integrii/flaggy"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	envAddress = "LISTEN_ADDR"
-	envUser = "AUTH_USER"
-	envPassword = "AUTH_PASSWORD"
+	envAddress     = "LISTEN_ADDR"
+	envUser        = "AUTH_USER"
+	envPassword    = "AUTH_PASSWORD"
 	envDisableAuth = "DISABLE_AUTH"
+	envRetries     = "RETRIES"
+	envMaxStale    = "MAX_STALE"
+	envConfig      = "CONFIG_FILE"
+	envHostLimit   = "HOST_LIMIT"
+	envStore       = "STORE_FILE"
+	envBaseUrl     = "BASE_URL"
+	envWebsub      = "WEBSUB"
+	envWebsubLocal = "WEBSUB_PRIVATE_CALLBACKS"
+	envLogLevel    = "LOG_LEVEL"
+	envLogFormat   = "LOG_FORMAT"
+	envShutdown    = "SHUTDOWN_TIMEOUT"
+	envTlsCert     = "TLS_CERT"
+	envTlsKey      = "TLS_KEY"
+	envRedirect    = "HTTP_REDIRECT"
+	envAcmeDomains = "ACME_DOMAINS"
+	envAcmeEmail   = "ACME_EMAIL"
+	envAcmeDir     = "ACME_DIRECTORY"
+	envAcmeCache   = "ACME_CACHE"
+	envAcmeCA      = "ACME_CA"
+	envReadTimeout = "READ_TIMEOUT"
+	envHeaderTime  = "READ_HEADER_TIMEOUT"
+	envWriteTime   = "WRITE_TIMEOUT"
+	envIdleTimeout = "IDLE_TIMEOUT"
+	envMaxHeader   = "MAX_HEADER_BYTES"
+	envReqTimeout  = "REQUEST_TIMEOUT"
+	envAdminUser   = "ADMIN_USER"
+	envAdminPass   = "ADMIN_PASSWORD"
 	defaultAddress = ":80"
+	defaultLevel   = "info"
+	defaultFormat  = "console"
+
+	defaultShutdownTimeout = 30 * time.Second
+	defaultReadTimeout     = 10 * time.Second
+	defaultHeaderTimeout   = 5 * time.Second
+	defaultWriteTimeout    = 60 * time.Second
+	defaultIdleTimeout     = 120 * time.Second
+	defaultMaxHeaderBytes  = 1 << 20
+	defaultRequestTimeout  = 30 * time.Second
 )
 
 var (
@@ -25,23 +69,150 @@ var (
 
 func main() {
 
-	log.Logger = zerolog.New(zerolog.NewConsoleWriter()).With().Timestamp().Str("version", version).Caller().Logger()
+	log.Logger = zerolog.New(zerolog.NewConsoleWriter(toStderr)).With().Timestamp().Str("version", version).Caller().Logger()
 
 	address := defaultAddress
 	authUser := ""
 	authPass := ""
 	disableAuth := false
+	retries := defaultRetries
+	maxStale := defaultMaxStale
+	configFile := ""
+	hostLimit := defaultHostLimit
+	storeFile := ""
+	baseUrl := ""
+	enableWebsub := false
+	websubPrivate := false
+	logLevel := defaultLevel
+	logFormat := defaultFormat
+	shutdownTimeout := defaultShutdownTimeout
+	tlsCert := ""
+	tlsKey := ""
+	redirectAddress := ""
+	acmeDomains := ""
+	acmeEmail := ""
+	acmeDir := ""
+	acmeCache := ""
+	acmeCA := ""
+	readTimeout := defaultReadTimeout
+	headerTimeout := defaultHeaderTimeout
+	writeTimeout := defaultWriteTimeout
+	idleTimeout := defaultIdleTimeout
+	maxHeaderBytes := defaultMaxHeaderBytes
+	requestTimeout := defaultRequestTimeout
+	adminUser := ""
+	adminPass := ""
+	var filterOpts filterOptions
 	flaggy.SetVersion(version)
 	flaggy.String(&address, "a", "address", "The local address the server listens on, in the for <address>:<port>.")
 	flaggy.String(&authUser, "u", "auth_user", "User part for basic http authentication of the endpoint.")
 	flaggy.String(&authPass, "p", "auth_password", "Secret part for basic http authentication of the endpoint.")
 	flaggy.Bool(&disableAuth, "", "disable_auth", "Disable authentication.")
+	flaggy.Int(&retries, "r", "retries", "Number of retries for transient upstream errors.")
+	flaggy.Duration(&maxStale, "", "max_stale", "Max age of the last filtered feed that is served if the upstream fails, 0 disables it.")
+	flaggy.String(&configFile, "c", "config", "Path to a JSON config file with named feeds that are polled in the background.")
+	flaggy.Int(&hostLimit, "", "host_limit", "Max number of concurrent polls against the same upstream host.")
+	flaggy.String(&storeFile, "s", "store", "Path to the database that keeps the history of named feeds.")
+	flaggy.String(&baseUrl, "b", "base_url", "The public URL under which rss-filter is reachable, e.g. https://rss.example.org.")
+	flaggy.Bool(&enableWebsub, "", "websub", "Enable WebSub for named feeds, requires the base url.")
+	flaggy.Bool(&websubPrivate, "", "websub_private_callbacks", "Allow WebSub subscribers with callbacks on loopback, link-local and private addresses.")
+	flaggy.String(&logLevel, "", "log_level", "The log level: trace, debug, info, warn or error.")
+	flaggy.String(&logFormat, "", "log_format", "The log format: console or json.")
+	flaggy.Duration(&shutdownTimeout, "", "shutdown_timeout", "Max time to wait for running requests and polls on shutdown.")
+	flaggy.String(&tlsCert, "", "tls_cert", "Path to the TLS certificate, enables HTTPS. The file is reloaded when it changes.")
+	flaggy.String(&tlsKey, "", "tls_key", "Path to the private key of the TLS certificate.")
+	flaggy.String(&redirectAddress, "", "http_redirect", "Address of a plain HTTP server that redirects to HTTPS, e.g. :80.")
+	flaggy.String(&acmeDomains, "", "acme_domains", "Comma separated domains to obtain certificates for with ACME, enables HTTPS.")
+	flaggy.String(&acmeEmail, "", "acme_email", "Contact email for the ACME account.")
+	flaggy.String(&acmeDir, "", "acme_directory", "Directory URL of the ACME server, defaults to Let's Encrypt.")
+	flaggy.String(&acmeCache, "", "acme_cache", "Directory to store the ACME account and certificates in.")
+	flaggy.String(&acmeCA, "", "acme_ca", "Path to PEM encoded CA certificates to trust for the ACME server.")
+	flaggy.Duration(&readTimeout, "", "read_timeout", "Max duration for reading a request, including the body.")
+	flaggy.Duration(&headerTimeout, "", "read_header_timeout", "Max duration for reading the request headers.")
+	flaggy.Duration(&writeTimeout, "", "write_timeout", "Max duration from the end of the request headers to the end of the response, must be longer than the request timeout.")
+	flaggy.Duration(&idleTimeout, "", "idle_timeout", "Max time to wait for the next request on a keep-alive connection.")
+	flaggy.Int(&maxHeaderBytes, "", "max_header_bytes", "Max size of the request headers.")
+	flaggy.Duration(&requestTimeout, "", "request_timeout", "Max duration for fetching an upstream feed including retries, named feeds can override it, 0 disables it.")
+	flaggy.String(&adminUser, "", "admin_user", "User part for basic http authentication of the admin API.")
+	flaggy.String(&adminPass, "", "admin_password", "Secret part for basic http authentication of the admin API, enables the API to manage named feeds.")
+
+	filterCmd := flaggy.NewSubcommand("filter")
+	filterCmd.Description = "Filter a feed from a URL, a file or stdin and exit, without starting the server."
+	filterCmd.String(&filterOpts.url, "", "url", "URL of the feed to filter.")
+	filterCmd.String(&filterOpts.file, "", "file", "Path of the feed to filter, stdin is read if neither a url nor a file is given.")
+	filterCmd.String(&filterOpts.filter, "f", "filter", "The filter, all items are kept if it is empty.")
+	filterCmd.StringSlice(&filterOpts.rules, "", "rules", "A rule like 'if feed.Language == \"de\" then Title has word \"Bonn\"', can be repeated.")
+	filterCmd.String(&filterOpts.out, "o", "out", "The output format: rss, atom or json, defaults to the format of the feed.")
+	filterCmd.String(&filterOpts.write, "w", "write", "Write the feed to this file instead of stdout, the file is replaced atomically.")
+	filterCmd.String(&filterOpts.user, "", "feed_user", "User for basic http authentication at the feed url.")
+	filterCmd.String(&filterOpts.password, "", "feed_password", "Password for basic http authentication at the feed url.")
+	filterCmd.StringSlice(&filterOpts.score, "", "score", "A score rule like 'Title ~= \"Bonn\" => +5', can be repeated.")
+	filterCmd.Float64(&filterOpts.threshold, "", "threshold", "Keep only items with a score above the threshold, if there are score rules.")
+	filterCmd.Bool(&filterOpts.showScore, "", "show_score", "Add the score to the items as a category.")
+	filterCmd.String(&filterOpts.sort, "", "sort", "Sort the kept items by published, updated or title.")
+	filterCmd.String(&filterOpts.order, "", "order", "The sort order: asc or desc, dates are sorted newest first by default.")
+	filterCmd.Int(&filterOpts.limit, "", "limit", "Max number of items in the output.")
+	filterCmd.Int(&filterOpts.offset, "", "offset", "Number of kept items to skip.")
+	flaggy.AttachSubcommand(filterCmd, 1)
+
+	explainCmd := flaggy.NewSubcommand("explain")
+	explainCmd.Description = "Explain for every item of a feed whether it passes the filter and why, as JSON."
+	explainCmd.String(&filterOpts.url, "", "url", "URL of the feed.")
+	explainCmd.String(&filterOpts.file, "", "file", "Path of the feed, stdin is read if neither a url nor a file is given.")
+	explainCmd.String(&filterOpts.filter, "f", "filter", "The filter to explain.")
+	explainCmd.StringSlice(&filterOpts.rules, "", "rules", "A rule like 'if feed.Language == \"de\" then Title has word \"Bonn\"', can be repeated.")
+	explainCmd.String(&filterOpts.write, "w", "write", "Write the explanation to this file instead of stdout.")
+	explainCmd.String(&filterOpts.user, "", "feed_user", "User for basic http authentication at the feed url.")
+	explainCmd.String(&filterOpts.password, "", "feed_password", "Password for basic http authentication at the feed url.")
+	explainCmd.StringSlice(&filterOpts.score, "", "score", "A score rule like 'Title ~= \"Bonn\" => +5', can be repeated.")
+	explainCmd.Float64(&filterOpts.threshold, "", "threshold", "The score an item must be above.")
+	flaggy.AttachSubcommand(explainCmd, 1)
 	flaggy.Parse()
 
 	adr := os.Getenv(envAddress)
 	user := os.Getenv(envUser)
 	pass := os.Getenv(envPassword)
 	disA := os.Getenv(envDisableAuth)
+	ret := os.Getenv(envRetries)
+	mStale := os.Getenv(envMaxStale)
+	cfg := os.Getenv(envConfig)
+	hLimit := os.Getenv(envHostLimit)
+	sto := os.Getenv(envStore)
+	bUrl := os.Getenv(envBaseUrl)
+	wSub := os.Getenv(envWebsub)
+	wLocal := os.Getenv(envWebsubLocal)
+	lLevel := os.Getenv(envLogLevel)
+	lFormat := os.Getenv(envLogFormat)
+	sTimeout := os.Getenv(envShutdown)
+	tCert := os.Getenv(envTlsCert)
+	tKey := os.Getenv(envTlsKey)
+	redir := os.Getenv(envRedirect)
+	aDomains := os.Getenv(envAcmeDomains)
+	aEmail := os.Getenv(envAcmeEmail)
+	aDir := os.Getenv(envAcmeDir)
+	aCache := os.Getenv(envAcmeCache)
+	aCA := os.Getenv(envAcmeCA)
+	rTimeout := os.Getenv(envReadTimeout)
+	hTimeout := os.Getenv(envHeaderTime)
+	wTimeout := os.Getenv(envWriteTime)
+	iTimeout := os.Getenv(envIdleTimeout)
+	mHeader := os.Getenv(envMaxHeader)
+	reqTimeout := os.Getenv(envReqTimeout)
+	aUser := os.Getenv(envAdminUser)
+	aPass := os.Getenv(envAdminPass)
+	if lLevel != "" && logLevel == defaultLevel {
+		logLevel = lLevel
+	}
+	if lFormat != "" && logFormat == defaultFormat {
+		logFormat = lFormat
+	}
+	if err := setupLogger(logLevel, logFormat); err != nil {
+		log.Fatal().Err(err).Msg("can't setup logging")
+	}
+	if err := setupTracing(); err != nil {
+		log.Fatal().Err(err).Msg("can't setup tracing")
+	}
+
 	if adr != "" && (address == defaultAddress || address == "") {
 		address = adr
 	}
@@ -59,22 +230,365 @@ func main() {
 		}
 	}
 
+	if ret != "" && retries == defaultRetries {
+		var err error
+		retries, err = strconv.Atoi(ret)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envRetries)
+		}
+	}
+	if mStale != "" && maxStale == defaultMaxStale {
+		var err error
+		maxStale, err = time.ParseDuration(mStale)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envMaxStale)
+		}
+	}
+	if cfg != "" && configFile == "" {
+		configFile = cfg
+	}
+	if sto != "" && storeFile == "" {
+		storeFile = sto
+	}
+	if bUrl != "" && baseUrl == "" {
+		baseUrl = bUrl
+	}
+	if wSub != "" && !enableWebsub {
+		var err error
+		enableWebsub, err = strconv.ParseBool(wSub)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envWebsub)
+		}
+	}
+	if wLocal != "" && !websubPrivate {
+		var err error
+		websubPrivate, err = strconv.ParseBool(wLocal)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envWebsubLocal)
+		}
+	}
+	if hLimit != "" && hostLimit == defaultHostLimit {
+		var err error
+		hostLimit, err = strconv.Atoi(hLimit)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envHostLimit)
+		}
+	}
+
+	if sTimeout != "" && shutdownTimeout == defaultShutdownTimeout {
+		var err error
+		shutdownTimeout, err = time.ParseDuration(sTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envShutdown)
+		}
+	}
+
+	if tCert != "" && tlsCert == "" {
+		tlsCert = tCert
+	}
+	if tKey != "" && tlsKey == "" {
+		tlsKey = tKey
+	}
+	if redir != "" && redirectAddress == "" {
+		redirectAddress = redir
+	}
+	if aDomains != "" && acmeDomains == "" {
+		acmeDomains = aDomains
+	}
+	if aEmail != "" && acmeEmail == "" {
+		acmeEmail = aEmail
+	}
+	if aDir != "" && acmeDir == "" {
+		acmeDir = aDir
+	}
+	if aCache != "" && acmeCache == "" {
+		acmeCache = aCache
+	}
+	if aCA != "" && acmeCA == "" {
+		acmeCA = aCA
+	}
+
+	if rTimeout != "" && readTimeout == defaultReadTimeout {
+		var err error
+		readTimeout, err = time.ParseDuration(rTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envReadTimeout)
+		}
+	}
+	if hTimeout != "" && headerTimeout == defaultHeaderTimeout {
+		var err error
+		headerTimeout, err = time.ParseDuration(hTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envHeaderTime)
+		}
+	}
+	if wTimeout != "" && writeTimeout == defaultWriteTimeout {
+		var err error
+		writeTimeout, err = time.ParseDuration(wTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envWriteTime)
+		}
+	}
+	if iTimeout != "" && idleTimeout == defaultIdleTimeout {
+		var err error
+		idleTimeout, err = time.ParseDuration(iTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envIdleTimeout)
+		}
+	}
+	if mHeader != "" && maxHeaderBytes == defaultMaxHeaderBytes {
+		var err error
+		maxHeaderBytes, err = strconv.Atoi(mHeader)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envMaxHeader)
+		}
+	}
+	if reqTimeout != "" && requestTimeout == defaultRequestTimeout {
+		var err error
+		requestTimeout, err = time.ParseDuration(reqTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't parse " + envReqTimeout)
+		}
+	}
+
+	if aUser != "" && adminUser == "" {
+		adminUser = aUser
+	}
+	if aPass != "" && adminPass == "" {
+		adminPass = aPass
+	}
+
+	if filterCmd.Used || explainCmd.Used {
+		run := runFilter
+		if explainCmd.Used {
+			run = runExplain
+		}
+		err := run(context.Background(), newFetcher(retries), requestTimeout, filterOpts, os.Stdin, os.Stdout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := tracer.shutdown(ctx); err != nil {
+			log.Err(err).Msg("can't export spans")
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("filtering failed")
+		}
+		return
+	}
+
 	if authPass == "" && !disableAuth {
 		log.Fatal().Msg("you MUST provide a password")
 	}
+	if enableWebsub && baseUrl == "" {
+		log.Fatal().Msg("WebSub requires the base url")
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal().Msg("the TLS certificate and key must be provided together")
+	}
+	if tlsCert != "" && acmeDomains != "" {
+		log.Fatal().Msg("use either a TLS certificate or ACME")
+	}
+	if redirectAddress != "" && tlsCert == "" && acmeDomains == "" {
+		log.Fatal().Msg("the HTTP redirect requires HTTPS")
+	}
+	if adminPass != "" && configFile == "" {
+		log.Fatal().Msg("the admin API requires a config file")
+	}
+	if writeTimeout > 0 && (requestTimeout <= 0 || writeTimeout <= requestTimeout) {
+		log.Warn().Dur("write_timeout", writeTimeout).Dur("request_timeout", requestTimeout).Msg("the write timeout should be longer than the request timeout, slow feeds are cut off")
+	}
+
+	conf := new(config)
+	if configFile != "" {
+		var err error
+		conf, err = loadConfig(configFile)
+		if errors.Is(err, os.ErrNotExist) && adminPass != "" {
+			// the admin API creates it
+			conf = new(config)
+			log.Info().Msgf("config not found, starting without feeds: '%s'", configFile)
+		} else if err != nil {
+			log.Fatal().Err(err).Str("config", configFile).Msg("can't load config")
+		} else {
+			log.Info().Int("feeds", len(conf.Feeds)).Msgf("config loaded: '%s'", configFile)
+		}
+	}
+
+	var store *itemStore
+	if storeFile != "" {
+		var err error
+		store, err = openStore(storeFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("store", storeFile).Msg("can't open store")
+		}
+	} else {
+		for _, fc := range conf.Feeds {
+			if fc.keepsHistory() {
+				log.Warn().Str("feed", fc.Name).Msg("feed keeps history, but no store is configured")
+			}
+			if len(fc.Notify) > 0 {
+				log.Warn().Str("feed", fc.Name).Msg("feed has notifications, but no store is configured, the notified items are not persisted")
+			}
+		}
+	}
+
+	fetcher := newFetcher(retries)
+	sched := newScheduler(fetcher, store, conf.Feeds, hostLimit, requestTimeout)
+	sched.baseUrl = strings.TrimSuffix(baseUrl, "/")
+	var ws *websub
+	if enableWebsub {
+		ws = newWebsub(baseUrl, sched, websubPrivate)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	sched.start(ctx)
+
+	handler = newRssHandler(authUser, authPass, disableAuth, fetcher, newStaleCache(maxStale), sched, ws, requestTimeout, baseUrl)
+	var admin http.Handler
+	if adminPass != "" {
+		admin = newAdminAPI(adminUser, adminPass, configFile, conf, sched)
+	}
 
-	handler = newRssHandler(authUser, authPass, disableAuth)
 	server := &http.Server{
-		Addr:           address,
-		Handler:        handler,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		Addr:              address,
+		Handler:           instrument(routes(handler, sched, ws, admin)),
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: headerTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	servers := []*http.Server{server}
+
+	var redirect http.Handler
+	if tlsCert != "" {
+		certs, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't load TLS certificate")
+		}
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.GetCertificate}
+		redirect = redirectHTTPS(address)
+	} else if acmeDomains != "" {
+		m, err := newAcmeManager(splitList(acmeDomains), acmeEmail, acmeDir, acmeCache, acmeCA)
+		if err != nil {
+			log.Fatal().Err(err).Msg("can't setup ACME")
+		}
+		server.TLSConfig = m.TLSConfig()
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+		redirect = m.HTTPHandler(redirectHTTPS(address))
+	}
+	if redirectAddress != "" {
+		servers = append(servers, &http.Server{
+			Addr:              redirectAddress,
+			Handler:           redirect,
+			ReadTimeout:       readTimeout,
+			ReadHeaderTimeout: headerTimeout,
+			WriteTimeout:      writeTimeout,
+			IdleTimeout:       idleTimeout,
+			MaxHeaderBytes:    maxHeaderBytes,
+		})
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				log.Info().Msgf("listening with TLS on: '%s'", srv.Addr)
+				errs <- srv.ListenAndServeTLS("", "")
+				return
+			}
+			log.Info().Msgf("listening on: '%s'", srv.Addr)
+			errs <- srv.ListenAndServe()
+		}(srv)
 	}
 
-	log.Info().Msgf("listening on: '%s'", address)
-	if err := server.ListenAndServe(); err != nil {
+	select {
+	case err := <-errs:
+		_ = store.Close()
 		log.Fatal().Err(err).Send()
+	case <-ctx.Done():
+	}
+	stop()
+	shutdown(servers, sched, ws, store, shutdownTimeout)
+}
+
+// routes returns the handler of the server. The health checks and the
+// WebSub callbacks don't require authentication, the admin API has its
+// own, it is disabled if admin is nil.
+func routes(handler http.Handler, sched *scheduler, ws *websub, admin http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", sched.serveReadyz)
+	if ws != nil {
+		mux.Handle("/websub/callback/", ws)
 	}
+	if admin != nil {
+		mux.Handle("/api/", admin)
+	} else {
+		mux.HandleFunc("/api/", func(w http.ResponseWriter, _ *http.Request) {
+			writeError(w, http.StatusNotFound, "the admin API is not enabled")
+		})
+	}
+	mux.Handle("/", handler)
+	return mux
+}
+
+// shutdown stops accepting requests and waits until running requests,
+// polls, notifications and WebSub deliveries are done or the timeout
+// expired. Then the spans are flushed and the store is closed, polls that
+// are still running can't write to it anymore.
+func shutdown(servers []*http.Server, sched *scheduler, ws *websub, store *itemStore, timeout time.Duration) {
+	log.Info().Dur("timeout", timeout).Msg("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Err(err).Str("address", server.Addr).Msg("not all requests finished")
+		}
+	}
+	if err := sched.wait(ctx); err != nil {
+		log.Err(err).Msg("not all polls and notifications finished")
+	}
+	if ws != nil {
+		if err := ws.wait(ctx); err != nil {
+			log.Err(err).Msg("not all websub deliveries finished")
+		}
+	}
+	// the spans are exported even if the timeout expired, they may tell
+	// what didn't finish
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancelFlush()
+	if err := tracer.shutdown(flushCtx); err != nil {
+		log.Err(err).Msg("can't export spans")
+	}
+	if err := store.Close(); err != nil {
+		log.Err(err).Msg("can't close store")
+	}
+	log.Info().Msg("stopped")
+}
+
+// setupLogger configures the global logger, the format is either console
+// or json.
+func setupLogger(level, format string) error {
+	lvl, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil {
+		return err
+	}
+	var l zerolog.Logger
+	switch strings.ToLower(format) {
+	case "console":
+		l = zerolog.New(zerolog.NewConsoleWriter(toStderr))
+	case "json":
+		l = zerolog.New(os.Stderr)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	log.Logger = l.Level(lvl).With().Timestamp().Str("version", version).Caller().Logger()
+	zerolog.DefaultContextLogger = &log.Logger
+	return nil
 }
 
+// toStderr writes console logs to stderr, stdout is reserved for the
+// output of the filter command.
+func toStderr(w *zerolog.ConsoleWriter) {
+	w.Out = os.Stderr
+}
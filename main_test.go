@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		stuck   bool
+		timeout time.Duration
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"requests finish", false, 5 * time.Second, 100 * time.Millisecond, 4 * time.Second},
+		{"timeout", true, 200 * time.Millisecond, 200 * time.Millisecond, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t)
+
+			// the collector records whether the store was still open when
+			// the spans were exported
+			var mu sync.Mutex
+			var exported, storeOpen bool
+			collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				exported = true
+				storeOpen = store.db.View(func(*bolt.Tx) error { return nil }) == nil
+			}))
+			t.Cleanup(collector.Close)
+			setupTestTracing(t, map[string]string{envOtelEndpoint: collector.URL})
+			_, sp := startSpan(context.Background(), "request", spanKindServer)
+			sp.finish()
+
+			// a poll and a WebSub delivery that don't finish
+			release := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-release
+			}))
+			t.Cleanup(upstream.Close)
+			sched := newScheduler(newFetcher(0), store, nil, defaultHostLimit, time.Minute)
+			ws := newWebsub("https://rss.example.org", sched, false)
+			ctx, cancel := context.WithCancel(context.Background())
+			sched.start(ctx)
+			// the poll is done before tracing is disabled again
+			t.Cleanup(func() {
+				close(release)
+				cancel()
+				_ = sched.wait(context.Background())
+			})
+			if tt.stuck {
+				fc := &feedConfig{Name: "news", URL: upstream.URL}
+				if err := fc.validate(); err != nil {
+					t.Fatal(err)
+				}
+				sched.set(fc)
+				ws.wg.Add(1)
+				t.Cleanup(ws.wg.Done)
+			}
+
+			// a request that is running when the shutdown starts
+			started := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(100 * time.Millisecond)
+				_, _ = w.Write([]byte("done"))
+			}))
+			t.Cleanup(srv.Close)
+			result := make(chan string, 1)
+			go func() {
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					result <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				result <- string(body)
+			}()
+			<-started
+
+			start := time.Now()
+			shutdown([]*http.Server{srv.Config}, sched, ws, store, tt.timeout)
+			if d := time.Since(start); d < tt.min || d > tt.max {
+				t.Errorf("shutdown took %s", d)
+			}
+			if got := <-result; got != "done" {
+				t.Errorf("running request: got %q", got)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !exported || !storeOpen {
+				t.Errorf("spans exported %t, store open then %t", exported, storeOpen)
+			}
+			if store.db.View(func(*bolt.Tx) error { return nil }) == nil {
+				t.Error("store not closed")
+			}
+		})
+	}
+}
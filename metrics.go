@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counterType   = "counter"
+	histogramType = "histogram"
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+var (
+	requestsTotal = newMetric(counterType, "rss_filter_requests_total",
+		"Number of handled HTTP requests.", "pipeline", "status")
+	requestDuration = newMetric(histogramType, "rss_filter_request_duration_seconds",
+		"Duration of handled HTTP requests.", "pipeline", "status")
+	fetchDuration = newMetric(histogramType, "rss_filter_upstream_fetch_duration_seconds",
+		"Duration of upstream fetches, by the host of named feeds, other for ad-hoc feeds.", "host", "code")
+	cacheRequests = newMetric(counterType, "rss_filter_cache_requests_total",
+		"Number of cache lookups.", "cache", "result")
+	staleLookups = newMetric(counterType, "rss_filter_stale_lookups_total",
+		"Number of lookups of the last filtered feed after the upstream failed.", "result")
+	parseFailures = newMetric(counterType, "rss_filter_parse_failures_total",
+		"Number of feeds and filters that could not be parsed.", "kind")
+	itemsTotal = newMetric(counterType, "rss_filter_items_total",
+		"Number of items of upstream feeds (in) and items that passed the filter (kept).", "pipeline", "state")
+
+	allMetrics = []*metric{requestsTotal, requestDuration, fetchDuration, cacheRequests, staleLookups, parseFailures, itemsTotal}
+)
+
+// metric is a counter or histogram with labels, it is exposed in the
+// Prometheus text format.
+type metric struct {
+	typ    string
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels  []string
+	value   float64
+	count   uint64
+	buckets []uint64
+}
+
+func newMetric(typ, name, help string, labels ...string) *metric {
+	return &metric{
+		typ:    typ,
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: map[string]*series{},
+	}
+}
+
+func (m *metric) get(labels []string) *series {
+	key := strings.Join(labels, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if m.typ == histogramType {
+			s.buckets = make([]uint64, len(defaultBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds v to the counter with the given label values.
+func (m *metric) add(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value += v
+}
+
+// inc increments the counter with the given label values.
+func (m *metric) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+// observe records v in the histogram with the given label values.
+func (m *metric) observe(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labels)
+	s.value += v
+	s.count++
+	for i, b := range defaultBuckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (m *metric) write(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.typ)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		if m.typ == counterType {
+			fmt.Fprintf(buf, "%s%s %s\n", m.name, m.labelString(s.labels, ""), formatFloat(s.value))
+			continue
+		}
+		for i, b := range defaultBuckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", m.name, m.labelString(s.labels, formatFloat(b)), s.buckets[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", m.name, m.labelString(s.labels, "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", m.name, m.labelString(s.labels, ""), formatFloat(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", m.name, m.labelString(s.labels, ""), s.count)
+	}
+}
+
+func (m *metric) labelString(values []string, le string) string {
+	var parts []string
+	for i, l := range m.labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, l, escapeLabel(v)))
+	}
+	if le != "" {
+		parts = append(parts, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// withNamedFeed marks ctx as belonging to the poll of a named feed, the
+// metrics of its upstream requests are labeled with the host.
+func withNamedFeed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, namedFeedKey, true)
+}
+
+// metricHost returns the host label of an upstream request. Anyone can
+// request ad-hoc feeds, so only the hosts of named feeds are used as
+// label values to keep the number of series bounded.
+func metricHost(ctx context.Context, host string) string {
+	if named, _ := ctx.Value(namedFeedKey).(bool); named {
+		return host
+	}
+	return "other"
+}
+
+// serveMetrics exposes all metrics in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	var buf bytes.Buffer
+	for _, m := range allMetrics {
+		m.write(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetricHost(t *testing.T) {
+	upstream, h := newTestServer(t)
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	if rec := request(t, h, url.Values{"feed_url": {upstream.URL + "/rss20.xml"}}); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	fc := &feedConfig{Name: "news", URL: upstream.URL + "/atom10.xml"}
+	if err := fc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	h.scheduler.set(fc)
+	if _, ok := h.scheduler.get(context.Background(), "news"); !ok {
+		t.Fatal("named feed not found")
+	}
+
+	rec := requestPath(t, h, "/metrics", nil)
+	body := rec.Body.String()
+	for _, s := range []string{
+		`rss_filter_upstream_fetch_duration_seconds_count{host="other",code="200"}`,
+		`rss_filter_upstream_fetch_duration_seconds_count{host="` + host + `",code="200"}`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("no %s in metrics", s)
+		}
+	}
+	if n := strings.Count(body, `host="`+host+`"`); n != len(defaultBuckets)+3 {
+		t.Errorf("ad-hoc feeds are labeled with their host: %d series lines", n)
+	}
+}
+
+func TestMetricUnknownFeed(t *testing.T) {
+	_, h := newTestServer(t)
+	srv := instrument(h)
+	for _, path := range []string{"/feeds/unknown-named", "/feeds/unknown-archive"} {
+		if rec := requestPath(t, srv, path, url.Values{"archive": {"1"}}); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d", path, rec.Code)
+		}
+		if rec := requestPath(t, srv, path, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d", path, rec.Code)
+		}
+	}
+
+	body := requestPath(t, h, "/metrics", nil).Body.String()
+	if strings.Contains(body, `pipeline="unknown-`) {
+		t.Errorf("unknown feeds are labeled with their name:\n%s", body)
+	}
+	if !strings.Contains(body, `rss_filter_requests_total{pipeline="",status="404"}`) {
+		t.Errorf("requests for unknown feeds are not counted:\n%s", body)
+	}
+}
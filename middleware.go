@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const headerRequestID = "X-Request-ID"
+
+type ctxKey int
+
+const (
+	requestInfoKey ctxKey = iota
+	spanKey
+	namedFeedKey
+)
+
+// requestInfo collects details about a request while it is handled.
+type requestInfo struct {
+	pipeline       string
+	upstreamStatus int
+	itemsIn        int
+	itemsKept      int
+}
+
+// info returns the requestInfo of the request, handlers fill it in.
+func info(r *http.Request) *requestInfo {
+	if ri, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return ri
+	}
+	return new(requestInfo)
+}
+
+// statusWriter records the status code and the size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+// instrument assigns a request ID, records the request metrics and
+// writes one access log line per request.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r.Header.Get(headerRequestID))
+		w.Header().Set(headerRequestID, id)
+
+		ctx, sp := startSpan(withRemoteParent(r.Context(), r.Header), r.Method+" "+r.URL.Path, spanKindServer)
+		sp.set("http.method", r.Method)
+		sp.set("http.target", r.URL.Path)
+		lc := log.With().Str("request_id", id)
+		if sp != nil {
+			lc = lc.Str("trace_id", sp.traceIDString())
+		}
+		l := lc.Logger()
+		ri := new(requestInfo)
+		ctx = context.WithValue(l.WithContext(ctx), requestInfoKey, ri)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		if ri.pipeline != "" {
+			sp.rename(r.Method + " " + ri.pipeline)
+			sp.set("rss_filter.pipeline", ri.pipeline)
+		}
+		sp.set("http.status_code", sw.status)
+		if sw.status >= 500 {
+			sp.fail(fmt.Errorf("%d %s", sw.status, http.StatusText(sw.status)))
+		}
+		sp.finish()
+		duration := time.Since(start)
+		status := strconv.Itoa(sw.status)
+		requestsTotal.inc(ri.pipeline, status)
+		requestDuration.observe(duration.Seconds(), ri.pipeline, status)
+
+		e := l.Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("pipeline", ri.pipeline).
+			Int("status", sw.status).
+			Int("bytes", sw.bytes).
+			Dur("duration", duration).
+			Str("remote", r.RemoteAddr)
+		if feedUrl := queryValue(r, "feed_url"); feedUrl != "" {
+			e = e.Str("feed_url", redactUrl(feedUrl))
+		}
+		if ri.upstreamStatus != 0 {
+			e = e.Int("upstream_status", ri.upstreamStatus)
+		}
+		if ri.pipeline != "" {
+			e = e.Int("items_in", ri.itemsIn).Int("items_kept", ri.itemsKept)
+		}
+		e.Msg("access")
+	})
+}
+
+// requestID returns the given request ID if it is usable, otherwise a
+// new random one.
+func requestID(id string) string {
+	if id != "" && len(id) <= 128 {
+		valid := true
+		for _, c := range id {
+			if c < 0x21 || c > 0x7e {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// queryValue returns the first value of the query parameter, the name
+// is matched case insensitive.
+func queryValue(r *http.Request, name string) string {
+	for k, v := range r.URL.Query() {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// queryValues returns all values of the query parameter, the name is
+// matched case insensitive.
+func queryValues(r *http.Request, name string) []string {
+	var values []string
+	for k, v := range r.URL.Query() {
+		if strings.EqualFold(k, name) {
+			values = append(values, v...)
+		}
+	}
+	return values
+}
+
+// countItems records the number of upstream and kept items of a pipeline.
+func countItems(pipeline string, in, kept int) {
+	itemsTotal.add(float64(in), pipeline, "in")
+	itemsTotal.add(float64(kept), pipeline, "kept")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	encjson "encoding/json"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// captureLog writes the log of the test to the returned buffer.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	l := log.Logger
+	log.Logger = zerolog.New(&buf)
+	t.Cleanup(func() { log.Logger = l })
+	return &buf
+}
+
+// accessLog returns the fields of the access log line in the log.
+func accessLog(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	for _, line := range strings.Split(buf.String(), "\n") {
+		var fields map[string]interface{}
+		if encjson.Unmarshal([]byte(line), &fields) == nil && fields["message"] == "access" {
+			return fields
+		}
+	}
+	t.Fatalf("no access log:\n%s", buf.String())
+	return nil
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		keep bool
+	}{
+		{"valid", "abc-123", true},
+		{"uuid", "0f8fad5b-d9cb-469f-a165-70867728950e", true},
+		{"max length", strings.Repeat("a", 128), true},
+		{"none", "", false},
+		{"too long", strings.Repeat("a", 129), false},
+		{"space", "abc 123", false},
+		{"newline", "abc\n123", false},
+		{"non ascii", "abc-ü", false},
+	}
+	h := instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.id != "" {
+			req.Header.Set(headerRequestID, tt.id)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		got := rec.Header().Get(headerRequestID)
+		if tt.keep && got != tt.id {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.id)
+		}
+		if !tt.keep && (got == tt.id || len(got) != 16) {
+			t.Errorf("%s: got %q, want a new id", tt.name, got)
+		}
+	}
+	if a, b := requestID(""), requestID(""); a == b {
+		t.Errorf("generated ids are not unique: %s", a)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		status   float64
+		bytes    float64
+		pipeline string
+	}{
+		{"implicit status", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}, http.StatusOK, 2, ""},
+		{"no body", func(w http.ResponseWriter, r *http.Request) {}, http.StatusOK, 0, ""},
+		{"error", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("failed"))
+		}, http.StatusBadGateway, 6, ""},
+		{"pipeline", func(w http.ResponseWriter, r *http.Request) {
+			ri := info(r)
+			ri.pipeline, ri.upstreamStatus, ri.itemsIn, ri.itemsKept = "news", http.StatusOK, 3, 2
+			_, _ = w.Write([]byte("<rss/>"))
+		}, http.StatusOK, 6, "news"},
+	}
+	for _, tt := range tests {
+		buf := captureLog(t)
+		req := httptest.NewRequest(http.MethodGet, "/feeds/news?x=1", nil)
+		req.Header.Set(headerRequestID, "req-1")
+		rec := httptest.NewRecorder()
+		instrument(tt.handler).ServeHTTP(rec, req)
+
+		fields := accessLog(t, buf)
+		if rec.Code != int(tt.status) || fields["status"] != tt.status || fields["bytes"] != tt.bytes {
+			t.Errorf("%s: got status %d, logged %v with %v bytes", tt.name, rec.Code, fields["status"], fields["bytes"])
+		}
+		for k, want := range map[string]interface{}{"method": "GET", "path": "/feeds/news", "request_id": "req-1", "remote": "192.0.2.1:1234", "pipeline": tt.pipeline} {
+			if fields[k] != want {
+				t.Errorf("%s: %s: got %v, want %v", tt.name, k, fields[k], want)
+			}
+		}
+		if _, ok := fields["duration"]; !ok {
+			t.Errorf("%s: no duration", tt.name)
+		}
+		_, hasItems := fields["items_in"]
+		if hasItems != (tt.pipeline != "") {
+			t.Errorf("%s: items logged: %t", tt.name, hasItems)
+		}
+		if tt.pipeline != "" && (fields["upstream_status"] != float64(http.StatusOK) || fields["items_in"] != float64(3) || fields["items_kept"] != float64(2)) {
+			t.Errorf("%s: got %v", tt.name, fields)
+		}
+	}
+}
+
+func TestAccessLogRedacts(t *testing.T) {
+	buf := captureLog(t)
+	upstream, h := newTestServer(t)
+	feedUrl := strings.Replace(upstream.URL, "http://", "http://alice:s3cret@", 1) + "/rss20.xml"
+	req := httptest.NewRequest(http.MethodGet, "/?"+url.Values{"feed_url": {feedUrl}}.Encode(), nil)
+	req.Header.Set("x-forward-user", "bob")
+	req.Header.Set("x-forward-password", "pa55word")
+	rec := httptest.NewRecorder()
+	instrument(h).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	fields := accessLog(t, buf)
+	if u, _ := fields["feed_url"].(string); !strings.Contains(u, "alice:xxxxx@") {
+		t.Errorf("feed url: got %q", u)
+	}
+	for _, secret := range []string{"s3cret", "pa55word"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("%s in the log:\n%s", secret, buf.String())
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mmcdole/gofeed"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayouts are tried for dates that gofeed can't parse.
+var dateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+	"2006/01/02",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 MST",
+	"Jan 2, 2006 3:04 PM",
+	"Jan 2, 2006 3:04:05 PM",
+	"January 2, 2006 3:04 PM",
+	"January 2, 2006 3:04:05 PM",
+	"Monday, January 2, 2006 3:04 PM",
+	"Monday, January 2, 2006",
+	"2 January 2006 15:04",
+	"02.01.2006 15:04:05",
+	"02.01.2006",
+}
+
+var dateComment = regexp.MustCompile(`\s*\([^)]*\)\s*$`)
+
+// parseFeed parses and normalizes an upstream feed.
+func parseFeed(data []byte) (*gofeed.Feed, error) {
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if feed == nil {
+		return nil, errors.New("empty feed")
+	}
+	normalizeFeed(feed)
+	return feed, nil
+}
+
+// normalizeFeed repairs what later stages rely on: nil items are dropped,
+// missing links and GUIDs are filled in and relative links are resolved.
+// Missing dates are parsed from the raw strings with additional layouts,
+// else items get the date of the feed, and the feed gets the date of its
+// newest item. Dates that are still unknown stay nil, a made up date would
+// change the rendered feed on every parse.
+func normalizeFeed(feed *gofeed.Feed) {
+	feed.Title = strings.TrimSpace(feed.Title)
+	feed.Link = strings.TrimSpace(feed.Link)
+	if feed.Link == "" && len(feed.Links) > 0 {
+		feed.Link = strings.TrimSpace(feed.Links[0])
+	}
+	base := absUrl(feed.FeedLink)
+	if feed.Link != "" {
+		if l, err := resolveUrl(base, feed.Link); err == nil {
+			feed.Link = l
+			if b := absUrl(l); b != nil {
+				base = b
+			}
+		}
+	}
+
+	items := feed.Items[:0]
+	for _, item := range feed.Items {
+		if item == nil {
+			continue
+		}
+		normalizeItem(item, base)
+		items = append(items, item)
+	}
+	feed.Items = items
+
+	if feed.UpdatedParsed == nil {
+		feed.UpdatedParsed = parseDate(feed.Updated)
+	}
+	if feed.PublishedParsed == nil {
+		feed.PublishedParsed = parseDate(feed.Published)
+	}
+	if feed.UpdatedParsed == nil {
+		feed.UpdatedParsed = newestItem(feed.Items)
+	}
+	if feed.UpdatedParsed == nil {
+		feed.UpdatedParsed = feed.PublishedParsed
+	}
+	if feed.PublishedParsed == nil {
+		feed.PublishedParsed = feed.UpdatedParsed
+	}
+
+	for _, item := range feed.Items {
+		if item.PublishedParsed == nil {
+			item.PublishedParsed = feed.PublishedParsed
+		}
+		if item.UpdatedParsed == nil {
+			item.UpdatedParsed = item.PublishedParsed
+		}
+	}
+}
+
+func normalizeItem(item *gofeed.Item, base *url.URL) {
+	item.Title = strings.TrimSpace(item.Title)
+	item.Link = strings.TrimSpace(item.Link)
+	if item.Link == "" && len(item.Links) > 0 {
+		item.Link = strings.TrimSpace(item.Links[0])
+	}
+	if item.Link != "" {
+		if l, err := resolveUrl(base, item.Link); err == nil {
+			item.Link = l
+		}
+	}
+	item.GUID = strings.TrimSpace(item.GUID)
+	if item.GUID == "" {
+		item.GUID = item.Link
+	}
+
+	enclosures := item.Enclosures[:0]
+	for _, enc := range item.Enclosures {
+		if enc != nil && enc.URL != "" {
+			enclosures = append(enclosures, enc)
+		}
+	}
+	item.Enclosures = enclosures
+
+	if item.PublishedParsed == nil {
+		item.PublishedParsed = parseDate(item.Published)
+	}
+	if item.UpdatedParsed == nil {
+		item.UpdatedParsed = parseDate(item.Updated)
+	}
+	if item.PublishedParsed == nil {
+		item.PublishedParsed = item.UpdatedParsed
+	}
+}
+
+// parseDate parses dates that gofeed doesn't understand, it returns nil
+// if s is not a date.
+func parseDate(s string) *time.Time {
+	s = strings.TrimSpace(dateComment.ReplaceAllString(s, ""))
+	if s == "" {
+		return nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) >= 9 && len(s) <= 10 {
+		t := time.Unix(sec, 0).UTC()
+		return &t
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			t = t.UTC()
+			return &t
+		}
+	}
+	return nil
+}
+
+// newestItem returns the latest date of the items, or nil.
+func newestItem(items []*gofeed.Item) *time.Time {
+	var newest *time.Time
+	for _, item := range items {
+		for _, t := range []*time.Time{item.UpdatedParsed, item.PublishedParsed} {
+			if t != nil && (newest == nil || t.After(*newest)) {
+				newest = t
+			}
+		}
+	}
+	return newest
+}
+
+// absUrl parses an absolute URL, it returns nil for anything else.
+func absUrl(s string) *url.URL {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || !u.IsAbs() {
+		return nil
+	}
+	return u
+}
+
+// resolveUrl resolves a link relative to the base, if there is one.
+func resolveUrl(base *url.URL, link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link, err
+	}
+	if base == nil || u.IsAbs() {
+		return link, nil
+	}
+	return base.ResolveReference(u).String(), nil
+}
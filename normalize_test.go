@@ -0,0 +1,204 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseFeedMalformed(t *testing.T) {
+	tests := []struct {
+		file    string
+		wantErr bool
+		updated time.Time
+		items   []time.Time
+	}{
+		{file: "no-channel-dates.xml", updated: date("2006-01-04T10:00:00Z"),
+			items: []time.Time{date("2006-01-02T15:04:05Z"), date("2006-01-04T10:00:00Z")}},
+		{file: "odd-dates.xml", updated: date("2006-01-05T08:30:00Z"),
+			items: []time.Time{date("2006-01-02T15:04:00Z"), date("2006-01-02T15:04:05Z"),
+				date("2006-01-02T22:04:05Z"), date("2006-01-02T15:04:00Z"), date("2006-01-05T08:30:00Z")}},
+		{file: "relative-links.xml", updated: date("2006-01-02T15:04:05Z"),
+			items: []time.Time{date("2006-01-02T15:04:05Z"), date("2006-01-02T15:04:05Z")}},
+		{file: "atom-missing-updated.xml", updated: date("2006-01-03T10:00:00Z"),
+			items: []time.Time{date("2006-01-03T10:00:00Z"), date("2006-01-02T10:00:00Z")}},
+		{file: "json-missing-dates.json", updated: date("2006-01-02T15:04:05Z"),
+			items: []time.Time{date("2006-01-02T15:04:05Z"), date("2006-01-02T15:04:05Z")}},
+		{file: "empty.xml", wantErr: true},
+		{file: "html-page.xml", wantErr: true},
+		{file: "truncated.xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			feed, err := parseFeed(readFixture(t, filepath.Join("malformed", tt.file)))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got a feed with %d items", len(feed.Items))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if feed.UpdatedParsed == nil || !feed.UpdatedParsed.Equal(tt.updated) {
+				t.Errorf("feed updated = %v, want %v", feed.UpdatedParsed, tt.updated)
+			}
+			if feed.PublishedParsed == nil {
+				t.Error("feed published is nil")
+			}
+			if len(feed.Items) != len(tt.items) {
+				t.Fatalf("got %d items, want %d", len(feed.Items), len(tt.items))
+			}
+			for i, item := range feed.Items {
+				if item.PublishedParsed == nil || !item.PublishedParsed.Equal(tt.items[i]) {
+					t.Errorf("item %d published = %v, want %v", i, item.PublishedParsed, tt.items[i])
+				}
+				if item.UpdatedParsed == nil {
+					t.Errorf("item %d updated is nil", i)
+				}
+			}
+
+			// every format must render without zero dates
+			keepAll, err := parseFilter("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			newFeed, _ := filterFeed(feed, keepAll, nil, nil, listOptions{})
+			for _, fm := range []format{rss, atom, json} {
+				body, _, err := renderFeed(newFeed, nil, fm)
+				if err != nil {
+					t.Fatalf("%s: %v", fm, err)
+				}
+				if strings.Contains(body, "0001-01-01") || strings.Contains(body, "01 Jan 0001") {
+					t.Errorf("%s: zero date in output:\n%s", fm, body)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFeedWithoutDates(t *testing.T) {
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		feed, err := parseFeed(readFixture(t, "malformed/no-dates.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if feed.UpdatedParsed != nil || feed.PublishedParsed != nil {
+			t.Errorf("feed dates = %v %v, want nil", feed.UpdatedParsed, feed.PublishedParsed)
+		}
+		for i, item := range feed.Items {
+			if item.PublishedParsed != nil || item.UpdatedParsed != nil {
+				t.Errorf("item %d dates = %v %v, want nil", i, item.PublishedParsed, item.UpdatedParsed)
+			}
+		}
+		body, _, err := renderFeed(buildFeed(feed, feed.Items), nil, rss)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, body)
+	}
+	// an unchanged upstream feed renders the same feed, it isn't reported
+	// as changed on every poll
+	if bodies[0] != bodies[1] {
+		t.Errorf("rendered feed changed:\n%s\n%s", bodies[0], bodies[1])
+	}
+}
+
+func TestNormalizeLinks(t *testing.T) {
+	feed, err := parseFeed(readFixture(t, "malformed/relative-links.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Title != "Blog with sloppy markup" {
+		t.Errorf("feed title = %q", feed.Title)
+	}
+	want := []struct{ title, link, guid string }{
+		{"Relative link", "https://blog.example.org/posts/relative", "https://blog.example.org/posts/relative"},
+		{"Sibling link", "https://blog.example.org/posts/sibling", "https://blog.example.org/posts/sibling"},
+	}
+	for i, w := range want {
+		item := feed.Items[i]
+		if item.Title != w.title || item.Link != w.link || item.GUID != w.guid {
+			t.Errorf("item %d = %q %q %q, want %q %q %q", i, item.Title, item.Link, item.GUID, w.title, w.link, w.guid)
+		}
+	}
+	if len(feed.Items[1].Enclosures) != 0 {
+		t.Errorf("enclosure without url was kept: %+v", feed.Items[1].Enclosures[0])
+	}
+}
+
+func TestItemIDWithoutGUID(t *testing.T) {
+	var ids []string
+	for i := 0; i < 2; i++ {
+		feed, err := parseFeed(readFixture(t, "feeds/rss092.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range buildFeed(feed, feed.Items).Items {
+			ids = append(ids, item.Id)
+		}
+	}
+	if len(ids) != 4 || ids[0] == ids[1] || ids[0] != ids[2] || ids[1] != ids[3] || !strings.HasPrefix(ids[0], "urn:sha1:") {
+		t.Errorf("items without GUID and link: got ids %q", ids)
+	}
+}
+
+func TestNormalizeNilItems(t *testing.T) {
+	feed := &gofeed.Feed{Items: []*gofeed.Item{nil, {Title: "a"}, nil}}
+	normalizeFeed(feed)
+	if len(feed.Items) != 1 || feed.Items[0].Title != "a" {
+		t.Fatalf("got items %+v", feed.Items)
+	}
+	if feed.UpdatedParsed != nil || feed.Items[0].PublishedParsed != nil {
+		t.Errorf("dates were made up: %v %v", feed.UpdatedParsed, feed.Items[0].PublishedParsed)
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"2006/01/02 15:04:05", "2006-01-02T15:04:05Z"},
+		{"1136214245", "2006-01-02T15:04:05Z"},
+		{"Mon, 2 Jan 2006 15:04:05 -0700 (MST)", "2006-01-02T22:04:05Z"},
+		{"January 2, 2006 3:04 PM", "2006-01-02T15:04:00Z"},
+		{"02.01.2006", "2006-01-02T00:00:00Z"},
+		{"", ""},
+		{"42", ""},
+		{"yesterday", ""},
+	}
+	for _, tt := range tests {
+		got := parseDate(tt.in)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("parseDate(%q) = %v, want nil", tt.in, got)
+			}
+			continue
+		}
+		if got == nil || !got.Equal(date(tt.want)) {
+			t.Errorf("parseDate(%q) = %v, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	encjson "encoding/json"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	notifiedMaxAge  = 90 * 24 * time.Hour
+	notifyTimeout   = 30 * time.Second
+	defaultTitle    = "{{.Item.Title}}"
+	defaultMessage  = "{{.Item.Title}}\n{{.Item.Link}}"
+	defaultSmtpPort = "25"
+)
+
+// notifyConfig configures a notification sink of a named feed. Title and
+// Message are text/template strings that are executed with a
+// notification.
+type notifyConfig struct {
+	Type     string   `json:"type"`
+	URL      string   `json:"url,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Room     string   `json:"room,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Title    string   `json:"title,omitempty"`
+	Message  string   `json:"message,omitempty"`
+
+	title   *template.Template
+	message *template.Template
+}
+
+// notification is a newly matched item, it is the data of the templates.
+type notification struct {
+	Feed    string       `json:"feed"`
+	Item    *gofeed.Item `json:"item"`
+	Title   string       `json:"title"`
+	Message string       `json:"message"`
+}
+
+// validate checks the sink and parses its templates.
+func (nc *notifyConfig) validate() error {
+	switch nc.Type {
+	case "webhook", "ntfy":
+		if nc.URL == "" {
+			return fmt.Errorf("%s: no url", nc.Type)
+		}
+	case "gotify":
+		if nc.URL == "" || nc.Token == "" {
+			return fmt.Errorf("gotify: url and token required")
+		}
+	case "matrix":
+		if nc.URL == "" || nc.Token == "" || nc.Room == "" {
+			return fmt.Errorf("matrix: url, token and room required")
+		}
+	case "smtp":
+		if nc.Host == "" || nc.From == "" || len(nc.To) == 0 {
+			return fmt.Errorf("smtp: host, from and to required")
+		}
+	default:
+		return fmt.Errorf("unknown notification type: %s", nc.Type)
+	}
+
+	var err error
+	title, message := nc.Title, nc.Message
+	if title == "" {
+		title = defaultTitle
+	}
+	if message == "" {
+		message = defaultMessage
+	}
+	if nc.title, err = template.New("title").Parse(title); err != nil {
+		return fmt.Errorf("%s: can't parse title: %w", nc.Type, err)
+	}
+	if nc.message, err = template.New("message").Parse(message); err != nil {
+		return fmt.Errorf("%s: can't parse message: %w", nc.Type, err)
+	}
+	return nil
+}
+
+// id identifies the sink in the notified state, it doesn't change if
+// sinks are added or reordered.
+func (nc *notifyConfig) id() string {
+	h := sha1.Sum([]byte(strings.Join(append([]string{nc.Type, nc.URL, nc.Room, nc.Host}, nc.To...), "\x00")))
+	return hex.EncodeToString(h[:8])
+}
+
+// notifier sends notifications for items that newly matched the filter
+// of a named feed, every item is notified once per sink. The feeds are
+// notified independently, so a slow sink only delays its own feed.
+type notifier struct {
+	store  *itemStore
+	client *http.Client
+
+	mu    sync.Mutex
+	seen  map[string]map[string]bool
+	locks map[string]*sync.Mutex
+}
+
+func newNotifier(store *itemStore) *notifier {
+	return &notifier{
+		store:  store,
+		client: &http.Client{Timeout: notifyTimeout},
+		seen:   map[string]map[string]bool{},
+		locks:  map[string]*sync.Mutex{},
+	}
+}
+
+// lock returns the lock that serializes the notifications of the feed.
+func (n *notifier) lock(feed string) *sync.Mutex {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l, ok := n.locks[feed]
+	if !ok {
+		l = new(sync.Mutex)
+		n.locks[feed] = l
+	}
+	return l
+}
+
+// notify sends the notifications for the items that were not notified
+// yet. If there is no notification state for a sink yet, the items are
+// only recorded, so a new feed or a sink that is added to a feed doesn't
+// flood the sink.
+func (n *notifier) notify(fc *feedConfig, items []*gofeed.Item) {
+	if len(fc.Notify) == 0 {
+		return
+	}
+	lock := n.lock(fc.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	done, err := n.notified(fc.Name)
+	if err != nil {
+		log.Err(err).Str("feed", fc.Name).Msg("can't read notification state")
+		return
+	}
+	initialized := initializedSinks(done)
+
+	var keys []string
+	for _, nc := range fc.Notify {
+		// the id alone records that the sink has a state, even if no
+		// item matched yet
+		keys = append(keys, nc.id())
+	}
+	for _, item := range items {
+		for _, nc := range fc.Notify {
+			key := nc.id() + "/" + itemKey(item)
+			if initialized[nc.id()] && !done[key] {
+				if err := n.send(nc, fc.Name, item); err != nil {
+					log.Err(err).Str("feed", fc.Name).Str("type", nc.Type).Str("item", itemKey(item)).Msg("notification failed")
+					continue
+				}
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	if err := n.markNotified(fc.Name, keys); err != nil {
+		log.Err(err).Str("feed", fc.Name).Msg("can't write notification state")
+	}
+}
+
+// initializedSinks returns the ids of the sinks that have a notification
+// state, the keys of the notified state are the sink ids and the sink ids
+// with the item keys.
+func initializedSinks(done map[string]bool) map[string]bool {
+	sinks := map[string]bool{}
+	for k := range done {
+		id, _, _ := strings.Cut(k, "/")
+		sinks[id] = true
+	}
+	return sinks
+}
+
+func (n *notifier) notified(feed string) (map[string]bool, error) {
+	if n.store != nil {
+		return n.store.notified(feed)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	done := map[string]bool{}
+	for k := range n.seen[feed] {
+		done[k] = true
+	}
+	return done, nil
+}
+
+func (n *notifier) markNotified(feed string, keys []string) error {
+	if n.store != nil {
+		return n.store.markNotified(feed, keys, notifiedMaxAge)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	done, ok := n.seen[feed]
+	if !ok {
+		done = map[string]bool{}
+		n.seen[feed] = done
+	}
+	for _, k := range keys {
+		done[k] = true
+	}
+	return nil
+}
+
+func (n *notifier) send(nc *notifyConfig, feed string, item *gofeed.Item) error {
+	nt := notification{Feed: feed, Item: item}
+	var title, message bytes.Buffer
+	if err := nc.title.Execute(&title, nt); err != nil {
+		return err
+	}
+	if err := nc.message.Execute(&message, nt); err != nil {
+		return err
+	}
+	nt.Title = title.String()
+	nt.Message = message.String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	switch nc.Type {
+	case "webhook":
+		data, err := encjson.Marshal(nt)
+		if err != nil {
+			return err
+		}
+		return n.post(ctx, http.MethodPost, nc.URL, "application/json", data, nil)
+	case "ntfy":
+		header := http.Header{}
+		header.Set("Title", mimeHeader(nt.Title))
+		if item.Link != "" {
+			header.Set("Click", item.Link)
+		}
+		if nc.Priority > 0 {
+			header.Set("Priority", strconv.Itoa(nc.Priority))
+		}
+		if nc.Token != "" {
+			header.Set("Authorization", "Bearer "+nc.Token)
+		}
+		return n.post(ctx, http.MethodPost, nc.URL, "text/plain", []byte(nt.Message), header)
+	case "gotify":
+		data, err := encjson.Marshal(map[string]interface{}{
+			"title":    nt.Title,
+			"message":  nt.Message,
+			"priority": nc.Priority,
+		})
+		if err != nil {
+			return err
+		}
+		u := strings.TrimSuffix(nc.URL, "/") + "/message?token=" + url.QueryEscape(nc.Token)
+		return n.post(ctx, http.MethodPost, u, "application/json", data, nil)
+	case "matrix":
+		data, err := encjson.Marshal(map[string]string{
+			"msgtype": "m.text",
+			"body":    nt.Message,
+		})
+		if err != nil {
+			return err
+		}
+		txn := nc.id() + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+			strings.TrimSuffix(nc.URL, "/"), url.PathEscape(nc.Room), txn)
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+nc.Token)
+		return n.post(ctx, http.MethodPut, u, "application/json", data, header)
+	case "smtp":
+		return sendMail(nc, nt)
+	}
+	return fmt.Errorf("unknown notification type: %s", nc.Type)
+}
+
+func (n *notifier) post(ctx context.Context, method, u, contentType string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", userAgent())
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s returned %s: %s", u, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// sendMail sends the notification like smtp.SendMail, but gives up
+// after notifyTimeout.
+func sendMail(nc *notifyConfig, nt notification) error {
+	host := nc.Host
+	if !strings.Contains(host, ":") {
+		host += ":" + defaultSmtpPort
+	}
+	h, _, _ := strings.Cut(host, ":")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", nc.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(nc.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mimeHeader(nt.Title))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(nt.Message, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	conn, err := net.DialTimeout("tcp", host, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(notifyTimeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, h)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: h}); err != nil {
+			return err
+		}
+	}
+	if nc.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", nc.User, nc.Password, h)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(nc.From); err != nil {
+		return err
+	}
+	for _, to := range nc.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// mimeHeader encodes a header value that contains non ASCII characters
+// or line breaks.
+func mimeHeader(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	for _, c := range s {
+		if c > 127 {
+			return mime.QEncoding.Encode("utf-8", s)
+		}
+	}
+	return s
+}
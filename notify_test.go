@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"github.com/mmcdole/gofeed"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sinkRequest is a request a notification sink received.
+type sinkRequest struct {
+	method, path, query string
+	header              http.Header
+	body                string
+}
+
+func newTestSink(t *testing.T) (*httptest.Server, func() []sinkRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []sinkRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, sinkRequest{r.Method, r.URL.Path, r.URL.RawQuery, r.Header, string(data)})
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []sinkRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sinkRequest(nil), requests...)
+	}
+}
+
+func notifyFeed(t *testing.T, name string, sinks ...*notifyConfig) *feedConfig {
+	t.Helper()
+	for _, nc := range sinks {
+		if err := nc.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &feedConfig{Name: name, Notify: sinks}
+}
+
+func TestNotifyOnce(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		var store *itemStore
+		if persistent {
+			store = openTestStore(t)
+		}
+		n := newNotifier(store)
+		srv, requests := newTestSink(t)
+		fc := notifyFeed(t, "news", &notifyConfig{Type: "webhook", URL: srv.URL})
+		a := &gofeed.Item{GUID: "a", Title: "Bonn opens new bridge"}
+		b := &gofeed.Item{GUID: "b", Title: "Cologne cathedral closed"}
+		c := &gofeed.Item{GUID: "c", Title: "Bonn wins"}
+
+		// the first poll only records the items
+		n.notify(fc, []*gofeed.Item{a, b})
+		if got := len(requests()); got != 0 {
+			t.Fatalf("persistent %t: first poll sent %d notifications", persistent, got)
+		}
+		n.notify(fc, []*gofeed.Item{a, b, c})
+		n.notify(fc, []*gofeed.Item{c, a})
+		got := requests()
+		if len(got) != 1 || !strings.Contains(got[0].body, `"title":"Bonn wins"`) {
+			t.Errorf("persistent %t: got %+v", persistent, got)
+		}
+
+		// another sink of the same feed has its own state, it starts
+		// like a new feed
+		srv2, requests2 := newTestSink(t)
+		fc = notifyFeed(t, "news", &notifyConfig{Type: "webhook", URL: srv.URL}, &notifyConfig{Type: "webhook", URL: srv2.URL})
+		n.notify(fc, []*gofeed.Item{a, c})
+		if len(requests()) != 1 || len(requests2()) != 0 {
+			t.Errorf("persistent %t: added sink: %d and %d notifications", persistent, len(requests()), len(requests2()))
+		}
+		d := &gofeed.Item{GUID: "d", Title: "Bonn builds another bridge"}
+		n.notify(fc, []*gofeed.Item{a, c, d})
+		if len(requests()) != 2 || len(requests2()) != 1 {
+			t.Errorf("persistent %t: new item: %d and %d notifications", persistent, len(requests()), len(requests2()))
+		}
+
+		// a sink with a changed url is a new sink
+		srv3, requests3 := newTestSink(t)
+		fc = notifyFeed(t, "news", &notifyConfig{Type: "webhook", URL: srv.URL}, &notifyConfig{Type: "webhook", URL: srv3.URL})
+		n.notify(fc, []*gofeed.Item{a, c, d})
+		if len(requests()) != 2 || len(requests3()) != 0 {
+			t.Errorf("persistent %t: changed sink: %d and %d notifications", persistent, len(requests()), len(requests3()))
+		}
+	}
+}
+
+func TestNotifySinks(t *testing.T) {
+	srv, requests := newTestSink(t)
+	item := &gofeed.Item{GUID: "a", Title: "Köln: Brücke\ngesperrt", Link: "https://example.org/a"}
+	sinks := []*notifyConfig{
+		{Type: "webhook", URL: srv.URL + "/hook"},
+		{Type: "ntfy", URL: srv.URL + "/topic", Token: "tk", Priority: 4},
+		{Type: "gotify", URL: srv.URL + "/", Token: "gt", Priority: 5},
+		{Type: "matrix", URL: srv.URL, Token: "mx", Room: "!room:example.org", Message: "{{.Feed}}: {{.Item.Title}}"},
+	}
+	n := newNotifier(nil)
+	for _, nc := range sinks {
+		if err := nc.validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.send(nc, "news", item); err != nil {
+			t.Errorf("%s: %v", nc.Type, err)
+		}
+	}
+
+	got := requests()
+	if len(got) != 4 {
+		t.Fatalf("got %d requests", len(got))
+	}
+	if r := got[0]; r.method != http.MethodPost || r.path != "/hook" || r.header.Get("Content-Type") != "application/json" || !strings.Contains(r.body, `"feed":"news"`) {
+		t.Errorf("webhook: %+v", r)
+	}
+	if r := got[1]; r.path != "/topic" || r.header.Get("Title") != "=?utf-8?q?K=C3=B6ln:_Br=C3=BCcke_gesperrt?=" || r.header.Get("Click") != item.Link ||
+		r.header.Get("Priority") != "4" || r.header.Get("Authorization") != "Bearer tk" || r.body != "Köln: Brücke\ngesperrt\nhttps://example.org/a" {
+		t.Errorf("ntfy: %+v", r)
+	}
+	if r := got[2]; r.path != "/message" || r.query != "token=gt" || !strings.Contains(r.body, `"priority":5`) {
+		t.Errorf("gotify: %+v", r)
+	}
+	if r := got[3]; r.method != http.MethodPut || !strings.HasPrefix(r.path, "/_matrix/client/v3/rooms/!room:example.org/send/m.room.message/") ||
+		r.header.Get("Authorization") != "Bearer mx" || !strings.Contains(r.body, `"body":"news: Köln: Brücke\ngesperrt"`) {
+		t.Errorf("matrix: %+v", r)
+	}
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer fail.Close()
+	nc := &notifyConfig{Type: "webhook", URL: fail.URL}
+	_ = nc.validate()
+	if err := n.send(nc, "news", item); err == nil {
+		t.Error("failing sink: expected an error")
+	}
+}
+
+func TestNotifySMTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	commands := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var got []string
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+		reply("220 test")
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			got = append(got, line)
+			switch {
+			case data && line == ".":
+				data = false
+				reply("250 queued")
+			case data:
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 test")
+			case line == "DATA":
+				data = true
+				reply("354 go ahead")
+			case line == "QUIT":
+				reply("221 bye")
+				commands <- got
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		commands <- got
+	}()
+
+	nc := &notifyConfig{Type: "smtp", Host: l.Addr().String(), From: "rss@example.org", To: []string{"a@example.org", "b@example.org"}}
+	if err := nc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := newNotifier(nil).send(nc, "news", &gofeed.Item{Title: "Bonn", Link: "https://example.org/a"}); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(<-commands, "\n")
+	for _, s := range []string{"MAIL FROM:<rss@example.org>", "RCPT TO:<a@example.org>", "RCPT TO:<b@example.org>", "Subject: Bonn", "https://example.org/a"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("no %s in:\n%s", s, got)
+		}
+	}
+}
+
+func TestNotifySlowSink(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast, requests := newTestSink(t)
+
+	n := newNotifier(nil)
+	slowFeed := notifyFeed(t, "slow", &notifyConfig{Type: "webhook", URL: slow.URL})
+	fastFeed := notifyFeed(t, "fast", &notifyConfig{Type: "webhook", URL: fast.URL})
+	n.notify(slowFeed, nil)
+	n.notify(fastFeed, nil)
+
+	go n.notify(slowFeed, []*gofeed.Item{{GUID: "a"}})
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		n.notify(fastFeed, []*gofeed.Item{{GUID: "a"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow sink blocks the notifications of other feeds")
+	}
+	if len(requests()) != 1 {
+		t.Errorf("got %d notifications", len(requests()))
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/text/unicode/norm"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// opml is an OPML 2.0 document, only the parts needed for subscription
+// lists are supported.
+type opml struct {
+	XMLName xml.Name      `xml:"opml"`
+	Version string        `xml:"version,attr"`
+	Title   string        `xml:"head>title,omitempty"`
+	Created string        `xml:"head>dateCreated,omitempty"`
+	Body    []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string        `xml:"htmlUrl,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// subscriptions returns the outlines with a feed url, also those nested
+// in categories.
+func (o *opml) subscriptions() []opmlOutline {
+	var list []opmlOutline
+	var walk func([]opmlOutline)
+	walk = func(outlines []opmlOutline) {
+		for _, ol := range outlines {
+			if strings.TrimSpace(ol.XMLURL) != "" {
+				list = append(list, ol)
+			}
+			walk(ol.Outlines)
+		}
+	}
+	walk(o.Body)
+	return list
+}
+
+// serveOPML returns an OPML document with the named feeds, so they can
+// be imported into a feed reader.
+func (h rssHandler) serveOPML(w http.ResponseWriter, r *http.Request) {
+	base := h.baseUrl
+	if base == "" {
+		base = requestBaseUrl(r)
+	}
+	doc := &opml{Version: "2.0", Title: "rss-filter", Created: time.Now().UTC().Format(time.RFC1123Z)}
+	for _, fc := range h.scheduler.list() {
+		doc.Body = append(doc.Body, opmlOutline{
+			Text:   fc.Name,
+			Title:  fc.Name,
+			Type:   "rss",
+			XMLURL: base + "/feeds/" + url.PathEscape(fc.Name),
+		})
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="rss-filter.opml"`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(data)
+}
+
+// requestBaseUrl returns the URL rss-filter was reached at, taking a
+// reverse proxy into account.
+func requestBaseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+	host := r.Host
+	if fh := r.Header.Get("X-Forwarded-Host"); fh != "" {
+		host = strings.TrimSpace(strings.Split(fh, ",")[0])
+	}
+	return scheme + "://" + host
+}
+
+// importOPML creates a named feed for every subscription of the uploaded
+// OPML file. The query parameters filter, out and interval are applied
+// to all of them. Subscriptions whose url is configured already are
+// skipped. The file is sent as the body with an XML content type or as
+// the file field of a form.
+func (a *adminAPI) importOPML(w http.ResponseWriter, r *http.Request) {
+	if !hasContentType(r, "text/x-opml", "application/xml", "text/xml", "multipart/form-data") {
+		writeError(w, http.StatusUnsupportedMediaType, "expected Content-Type: text/x-opml")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAdminBody)
+	var in io.Reader = r.Body
+	if hasContentType(r, "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("no file uploaded: %s", err.Error()))
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	doc := new(opml)
+	if err := xml.Unmarshal(data, doc); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("can't parse OPML: %s", err.Error()))
+		return
+	}
+
+	template := feedConfig{Filter: queryValue(r, "filter"), Out: queryValue(r, "out")}
+	if v := queryValue(r, "interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("can't parse interval: %s", err.Error()))
+			return
+		}
+		template.Interval = duration(d)
+	}
+	if _, err := parseFilter(template.Filter); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("can't parse filter: %s", err.Error()))
+		return
+	}
+
+	type skipped struct {
+		URL    string `json:"url"`
+		Reason string `json:"reason"`
+	}
+	result := struct {
+		Created []feedResource `json:"created"`
+		Skipped []skipped      `json:"skipped"`
+	}{Created: []feedResource{}, Skipped: []skipped{}}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names := map[string]bool{}
+	urls := map[string]bool{}
+	for _, fc := range a.conf.Feeds {
+		names[fc.Name] = true
+		urls[fc.URL] = true
+	}
+	var created []*feedConfig
+	for _, ol := range doc.subscriptions() {
+		u := strings.TrimSpace(ol.XMLURL)
+		if urls[u] {
+			result.Skipped = append(result.Skipped, skipped{redactUrl(u), "feed exists"})
+			continue
+		}
+		fc := template
+		fc.URL = u
+		fc.Name = uniqueName(slug(outlineName(ol)), names)
+		if err := fc.validate(); err != nil {
+			result.Skipped = append(result.Skipped, skipped{redactUrl(u), err.Error()})
+			continue
+		}
+		names[fc.Name] = true
+		urls[u] = true
+		created = append(created, &fc)
+	}
+
+	if len(created) > 0 {
+		if err := a.save(append(append([]*feedConfig{}, a.conf.Feeds...), created...)); err != nil {
+			log.Err(err).Str("config", a.path).Msg("can't save config")
+			writeError(w, http.StatusInternalServerError, "can't save config")
+			return
+		}
+	}
+	a.scheduler.setAll(created)
+	for _, fc := range created {
+		result.Created = append(result.Created, a.resource(fc))
+	}
+	log.Info().Int("created", len(result.Created)).Int("skipped", len(result.Skipped)).Msg("OPML imported")
+	writeJSON(w, http.StatusOK, result)
+}
+
+// outlineName returns the best name for a subscription: its title, its
+// text or the host of the feed.
+func outlineName(ol opmlOutline) string {
+	for _, s := range []string{ol.Title, ol.Text} {
+		if strings.TrimSpace(s) != "" {
+			return s
+		}
+	}
+	if u, err := url.Parse(strings.TrimSpace(ol.XMLURL)); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "feed"
+}
+
+// slug turns s into a feed name that only contains lower case letters,
+// digits and dashes, accents are removed.
+func slug(s string) string {
+	sb := strings.Builder{}
+	dash := false
+	for _, c := range norm.NFD.String(strings.ReplaceAll(strings.ToLower(s), "ß", "ss")) {
+		if unicode.Is(unicode.Mn, c) {
+			continue
+		}
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if sb.Len() == 0 {
+		return "feed"
+	}
+	return sb.String()
+}
+
+// uniqueName appends a number to name if it is taken.
+func uniqueName(name string, taken map[string]bool) string {
+	if !taken[name] {
+		return name
+	}
+	for i := 2; ; i++ {
+		if n := name + "-" + strconv.Itoa(i); !taken[n] {
+			return n
+		}
+	}
+}
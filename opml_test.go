@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportOPML(t *testing.T) {
+	upstream, _ := newTestServer(t)
+	sched := newScheduler(newFetcher(0), nil, nil, defaultHostLimit, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	sched.start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		_ = sched.wait(context.Background())
+	})
+	path := filepath.Join(t.TempDir(), "config.json")
+	a := newAdminAPI("admin", "secret", path, new(config), sched)
+
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="2.0">
+  <head><title>My subscriptions</title></head>
+  <body>
+    <outline text="News">
+      <outline type="rss" text="City news" title="Kölner Straße" xmlUrl="` + upstream.URL + `/rss20.xml"/>
+      <outline type="rss" text="Releases" xmlUrl="` + upstream.URL + `/atom10.xml"/>
+    </outline>
+    <outline type="rss" text="Releases" xmlUrl="` + upstream.URL + `/rdf.xml"/>
+    <outline type="rss" text="Duplicate" xmlUrl="` + upstream.URL + `/rss20.xml"/>
+    <outline text="Not a feed" htmlUrl="https://example.org/"/>
+  </body>
+</opml>`
+	rec := adminRequest(t, a, http.MethodPost, `/api/opml?filter=Title+~!+"^Breaking"&out=atom`, doc)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, s := range []string{`"name": "kolner-strasse"`, `"name": "releases"`, `"name": "releases-2"`, `"reason": "feed exists"`} {
+		if !strings.Contains(rec.Body.String(), s) {
+			t.Errorf("response doesn't contain %s:\n%s", s, rec.Body.String())
+		}
+	}
+
+	// the first polls are spread, they don't all start right away
+	time.Sleep(50 * time.Millisecond)
+	polled := 0
+	for _, name := range []string{"kolner-strasse", "releases", "releases-2"} {
+		if sched.state(name) != nil {
+			polled++
+		}
+	}
+	if polled == 3 {
+		t.Error("all imported feeds were polled at once")
+	}
+
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Feeds) != 3 {
+		t.Fatalf("got %d feeds, want 3", len(conf.Feeds))
+	}
+	for _, fc := range conf.Feeds {
+		if fc.Filter != `Title ~! "^Breaking"` || fc.Out != "atom" {
+			t.Errorf("%s: filter %q, out %q", fc.Name, fc.Filter, fc.Out)
+		}
+	}
+	if st, ok := sched.get(context.Background(), "releases"); !ok || st.itemsKept != 2 {
+		t.Errorf("imported feed not served: %+v", st)
+	}
+
+	// importing again skips all
+	rec = adminRequest(t, a, http.MethodPost, "/api/opml", doc)
+	if !strings.Contains(rec.Body.String(), `"created": []`) {
+		t.Errorf("second import created feeds:\n%s", rec.Body.String())
+	}
+
+	for _, body := range []string{"not xml", `<rss></rss>`} {
+		if rec := adminRequest(t, a, http.MethodPost, "/api/opml", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", body, rec.Code)
+		}
+	}
+	if rec := adminRequest(t, a, http.MethodPost, `/api/opml?filter=Title`, doc); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid filter: status %d", rec.Code)
+	}
+}
+
+func TestServeOPML(t *testing.T) {
+	f := newFetcher(0)
+	sched := newScheduler(f, nil, []*feedConfig{{Name: "b", URL: "x"}, {Name: "a b", URL: "y"}}, defaultHostLimit, 0)
+	for _, base := range []string{"", "https://rss.example.org/"} {
+		h := newRssHandler("", "", true, f, newStaleCache(0), sched, nil, 0, base)
+		req := httptest.NewRequest(http.MethodGet, "/opml", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "proxy.example.org")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/x-opml; charset=utf-8" {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+		}
+
+		doc := new(opml)
+		if err := xml.Unmarshal(rec.Body.Bytes(), doc); err != nil {
+			t.Fatal(err)
+		}
+		want := "https://proxy.example.org"
+		if base != "" {
+			want = "https://rss.example.org"
+		}
+		subs := doc.subscriptions()
+		if len(subs) != 2 || subs[0].XMLURL != want+"/feeds/a%20b" || subs[1].XMLURL != want+"/feeds/b" {
+			t.Errorf("unexpected outlines: %+v", subs)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listOptions sort the kept items and cut a page out of them.
+type listOptions struct {
+	sort   string
+	order  string
+	limit  int
+	offset int
+}
+
+// queryListOptions parses the sort, order, limit and offset parameters of
+// the request.
+func queryListOptions(r *http.Request) (listOptions, error) {
+	lo := listOptions{sort: strings.ToLower(queryValue(r, "sort")), order: strings.ToLower(queryValue(r, "order"))}
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{{"limit", &lo.limit}, {"offset", &lo.offset}} {
+		s := queryValue(r, p.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return lo, fmt.Errorf("invalid %s: %s", p.name, s)
+		}
+		*p.v = n
+	}
+	return lo, lo.validate()
+}
+
+func (lo listOptions) validate() error {
+	switch lo.sort {
+	case "", "published", "updated", "title":
+	default:
+		return fmt.Errorf("can't sort by %s, use published, updated or title", lo.sort)
+	}
+	switch lo.order {
+	case "", "asc", "desc":
+	default:
+		return fmt.Errorf("invalid order %s, use asc or desc", lo.order)
+	}
+	if lo.limit < 0 || lo.offset < 0 {
+		return fmt.Errorf("limit and offset must not be negative")
+	}
+	return nil
+}
+
+// apply returns the sorted page of the items, the items themselves are
+// left untouched. Dates are sorted newest first and titles alphabetically,
+// unless the order says otherwise. Items without a date are last.
+func (lo listOptions) apply(items []*gofeed.Item) []*gofeed.Item {
+	if lo.sort != "" {
+		items = append([]*gofeed.Item(nil), items...)
+		desc := lo.order == "desc" || (lo.order == "" && lo.sort != "title")
+		date := func(item *gofeed.Item) *time.Time { return item.PublishedParsed }
+		if lo.sort == "updated" {
+			date = func(item *gofeed.Item) *time.Time { return item.UpdatedParsed }
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			if lo.sort == "title" {
+				a, b := strings.ToLower(items[i].Title), strings.ToLower(items[j].Title)
+				if desc {
+					return a > b
+				}
+				return a < b
+			}
+			a, b := date(items[i]), date(items[j])
+			if a == nil || b == nil {
+				return a != nil && b == nil
+			}
+			if desc {
+				return a.After(*b)
+			}
+			return a.Before(*b)
+		})
+	}
+
+	if lo.offset >= len(items) {
+		return nil
+	}
+	items = items[lo.offset:]
+	if lo.limit > 0 && lo.limit < len(items) {
+		items = items[:lo.limit]
+	}
+	return items
+}
+
+// pagingLinks returns the first, previous, next and last links of RFC 5005
+// paged feeds for a list of total items, u is the url of the current page.
+// There are no links without a limit.
+func pagingLinks(u *url.URL, total int, lo listOptions) []feedLink {
+	if lo.limit <= 0 {
+		return nil
+	}
+	page := func(offset int) string {
+		p := *u
+		q := p.Query()
+		for k := range q {
+			if strings.EqualFold(k, "offset") {
+				q.Del(k)
+			}
+		}
+		if offset > 0 {
+			q.Set("offset", strconv.Itoa(offset))
+		}
+		p.RawQuery = q.Encode()
+		return p.String()
+	}
+
+	links := []feedLink{{Rel: "first", Href: page(0)}}
+	if lo.offset > 0 {
+		prev := lo.offset - lo.limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, feedLink{Rel: "previous", Href: page(prev)})
+	}
+	if lo.offset+lo.limit < total {
+		links = append(links, feedLink{Rel: "next", Href: page(lo.offset + lo.limit)})
+	}
+	if total > 0 {
+		links = append(links, feedLink{Rel: "last", Href: page((total - 1) / lo.limit * lo.limit)})
+	}
+	return links
+}
+
+// errNoPage is returned for a page that is not in the archive of a feed.
+var errNoPage = errors.New("no such page")
+
+// archivePages returns the number of complete pages in the archive of the
+// feed. Only feeds with a history and a limit have an archive, every page
+// has limit items in the order they were first seen, so a page doesn't
+// change once it is complete. The items of complete pages are not removed
+// by the limits of the history, only old pages are removed as a whole.
+func (s *scheduler) archivePages(fc *feedConfig) (uint64, error) {
+	if s.store == nil || !fc.keepsHistory() || fc.Limit <= 0 {
+		return 0, nil
+	}
+	seq, err := s.store.sequence(fc.Name)
+	return seq / uint64(fc.Limit), err
+}
+
+// archiveUrl returns the url of a page of the archive of the named feed,
+// or of the feed itself for page 0.
+func (s *scheduler) archiveUrl(name string, page uint64) string {
+	u := s.baseUrl + "/feeds/" + url.PathEscape(name)
+	if page > 0 {
+		u += "?archive=" + strconv.FormatUint(page, 10)
+	}
+	return u
+}
+
+// archive renders a page of the archive of the named feed as an RFC 5005
+// archive document, linked to the previous and next page and the current
+// feed.
+func (s *scheduler) archive(ctx context.Context, name string, page uint64) (string, string, error) {
+	fc, ok := s.feed(name)
+	if !ok {
+		return "", "", errNoPage
+	}
+	st, _ := s.get(ctx, name)
+	pages, err := s.archivePages(fc)
+	if err != nil {
+		return "", "", err
+	}
+	if st == nil || st.feed == nil || page < 1 || page > pages {
+		return "", "", errNoPage
+	}
+
+	// items that expired before their page was complete are gone, the
+	// archive starts at the page of the oldest stored item
+	size := uint64(fc.Limit)
+	first, err := s.store.firstSequence(name)
+	if err != nil {
+		return "", "", err
+	}
+	firstPage := (first + size - 1) / size
+	if first == 0 || page < firstPage {
+		return "", "", errNoPage
+	}
+	items, err := s.store.archive(name, (page-1)*size+1, page*size)
+	if err != nil {
+		return "", "", err
+	}
+	lo := fc.listOptions()
+	lo.limit, lo.offset = 0, 0
+	items = lo.apply(items)
+
+	links := []feedLink{{Rel: "current", Href: s.archiveUrl(name, 0)}, {Rel: "self", Href: s.archiveUrl(name, page)}}
+	if page > firstPage {
+		links = append(links, feedLink{Rel: "prev-archive", Href: s.archiveUrl(name, page-1)})
+	}
+	if page < pages {
+		links = append(links, feedLink{Rel: "next-archive", Href: s.archiveUrl(name, page+1)})
+	}
+	fm := resolveFormat(parseFormat(fc.Out), st.feed)
+	body, cType, err := renderFeed(buildFeed(st.feed, items), fc.scoring.categories(st.feed, items), fm, links...)
+	if err != nil {
+		return "", "", err
+	}
+	return markArchive(body, fm), cType, nil
+}
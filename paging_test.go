@@ -0,0 +1,179 @@
+package main
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListOptions(t *testing.T) {
+	feed, err := parseFeed(readFixture(t, "feeds/rss20.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		lo   listOptions
+		want []string
+	}{
+		{listOptions{}, []string{"Bonn opens new bridge", "Breaking: Cologne cathedral closed", "Sports: Bonn wins"}},
+		{listOptions{sort: "published"}, []string{"Sports: Bonn wins", "Breaking: Cologne cathedral closed", "Bonn opens new bridge"}},
+		{listOptions{sort: "published", order: "asc"}, []string{"Bonn opens new bridge", "Breaking: Cologne cathedral closed", "Sports: Bonn wins"}},
+		{listOptions{sort: "title", order: "desc"}, []string{"Sports: Bonn wins", "Breaking: Cologne cathedral closed", "Bonn opens new bridge"}},
+		{listOptions{sort: "published", limit: 2}, []string{"Sports: Bonn wins", "Breaking: Cologne cathedral closed"}},
+		{listOptions{sort: "published", limit: 2, offset: 2}, []string{"Bonn opens new bridge"}},
+		{listOptions{offset: 3}, []string{}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, item := range tt.lo.apply(feed.Items) {
+			got = append(got, item.Title)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %q, want %q", tt.lo, got, tt.want)
+		}
+	}
+	if feed.Items[0].Title != "Bonn opens new bridge" {
+		t.Error("apply changed the order of the items")
+	}
+
+	for _, lo := range []listOptions{{sort: "author"}, {order: "up"}, {limit: -1}} {
+		if lo.validate() == nil {
+			t.Errorf("%+v: expected an error", lo)
+		}
+	}
+}
+
+func TestPagingLinks(t *testing.T) {
+	upstream, h := newTestServer(t)
+	query := url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "sort": {"title"}, "limit": {"1"}, "offset": {"1"}, "out": {"atom"}}
+	rec := request(t, h, query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := titles(t, rec.Body.String()); !reflect.DeepEqual(got, []string{"Breaking: Cologne cathedral closed"}) {
+		t.Errorf("got %q", got)
+	}
+	page := func(offset string) string {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Del("offset")
+		if offset != "" {
+			q.Set("offset", offset)
+		}
+		return strings.ReplaceAll("http://example.com/?"+q.Encode(), "&", "&amp;")
+	}
+	for rel, href := range map[string]string{"first": page(""), "previous": page(""), "next": page("2"), "last": page("2")} {
+		if link := `<link href="` + href + `" rel="` + rel + `">`; !strings.Contains(rec.Body.String(), link) {
+			t.Errorf("no %s link %s in\n%s", rel, link, rec.Body.String())
+		}
+	}
+
+	query.Set("out", "json")
+	query.Set("offset", "2")
+	rec = request(t, h, query)
+	if strings.Contains(rec.Body.String(), "next_url") {
+		t.Errorf("next url on the last page:\n%s", rec.Body.String())
+	}
+
+	query.Set("limit", "x")
+	if rec = request(t, h, query); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit: status %d", rec.Code)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	upstream, _ := newTestServer(t)
+	store, err := openStore(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	fc := &feedConfig{Name: "news", URL: upstream.URL + "/rss20.xml", Out: "atom", HistoryItems: 10, Sort: "published", Limit: 2}
+	if err := fc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	f := newFetcher(0)
+	sched := newScheduler(f, store, []*feedConfig{fc}, defaultHostLimit, 5*time.Second)
+	h := newRssHandler("", "", true, f, newStaleCache(0), sched, nil, 5*time.Second, "")
+
+	rec := requestPath(t, h, "/feeds/news", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := titles(t, rec.Body.String()); !reflect.DeepEqual(got, []string{"Sports: Bonn wins", "Breaking: Cologne cathedral closed"}) {
+		t.Errorf("got %q", got)
+	}
+	if !strings.Contains(rec.Body.String(), `<link href="/feeds/news?archive=1" rel="prev-archive">`) {
+		t.Errorf("no link to the archive:\n%s", rec.Body.String())
+	}
+
+	rec = requestPath(t, h, "/feeds/news", url.Values{"archive": {"1"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if got := titles(t, body); !reflect.DeepEqual(got, []string{"Breaking: Cologne cathedral closed", "Bonn opens new bridge"}) {
+		t.Errorf("got %q", got)
+	}
+	for _, s := range []string{"<fh:archive", `<link href="/feeds/news" rel="current">`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("no %s in archive page:\n%s", s, body)
+		}
+	}
+	if strings.Contains(body, "next-archive") || strings.Contains(body, "prev-archive") {
+		t.Errorf("links to other pages of a single page archive:\n%s", body)
+	}
+
+	for page, status := range map[string]int{"0": http.StatusNotFound, "2": http.StatusNotFound, "x": http.StatusBadRequest} {
+		if rec := requestPath(t, h, "/feeds/news", url.Values{"archive": {page}}); rec.Code != status {
+			t.Errorf("page %s: status %d, want %d", page, rec.Code, status)
+		}
+	}
+}
+
+func TestArchiveStartsAtOldestItem(t *testing.T) {
+	upstream, _ := newTestServer(t)
+	store := openTestStore(t)
+	fc := &feedConfig{Name: "news", URL: upstream.URL + "/rss20.xml", Out: "atom", HistoryItems: 10, Limit: 1}
+	if err := fc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	f := newFetcher(0)
+	sched := newScheduler(f, store, []*feedConfig{fc}, defaultHostLimit, 5*time.Second)
+	h := newRssHandler("", "", true, f, newStaleCache(0), sched, nil, 5*time.Second, "")
+	if rec := requestPath(t, h, "/feeds/news", nil); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// the item of the first page expired before it was kept for the archive
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketItems, "news", false)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte("https://news.example.org/bonn/bridge"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := requestPath(t, h, "/feeds/news", url.Values{"archive": {"1"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("expired page: status %d", rec.Code)
+	}
+	rec := requestPath(t, h, "/feeds/news", url.Values{"archive": {"2"}})
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "prev-archive") {
+		t.Errorf("oldest page links to an expired page: status %d:\n%s", rec.Code, rec.Body.String())
+	}
+	rec = requestPath(t, h, "/feeds/news", url.Values{"archive": {"3"}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<link href="/feeds/news?archive=2" rel="prev-archive">`) {
+		t.Errorf("status %d:\n%s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/feeds"
+	"github.com/mmcdole/gofeed"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/goql"
+	"strings"
+	"time"
+)
+
+// parseFormat returns the output format for the given name, unknown
+// names keep the format of the upstream feed.
+func parseFormat(output string) format {
+	switch format(strings.ToLower(output)) {
+	case rss:
+		return rss
+	case atom:
+		return atom
+	case json:
+		return json
+	default:
+		return keep
+	}
+}
+
+// resolveFormat replaces keep with the format of the upstream feed.
+func resolveFormat(fm format, feed *gofeed.Feed) format {
+	if fm != keep {
+		return fm
+	}
+	switch format(strings.ToLower(feed.FeedType)) {
+	case rss:
+		return rss
+	case atom:
+		return atom
+	case json:
+		return json
+	default:
+		return atom
+	}
+}
+
+// parseFilter parses the filter expression, an empty filter keeps all items.
+func parseFilter(filter string) (goql.Conditions, error) {
+	t, err := newFilterParser(filter).parse()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConditions(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func validateConditions(t goql.Conditions) error {
+	for _, c := range t.Conditions() {
+		if err := validateCondition(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterFeed returns a new feed that contains the page of the items of
+// the upstream feed that met the conditions and the rules and have a high
+// enough score, and the categories to render them with.
+func filterFeed(feed *gofeed.Feed, t goql.Conditions, fr filterRules, sc *scoring, lo listOptions) (*feeds.Feed, []string) {
+	page := lo.apply(sc.keep(feed, matchItems(feed, t, fr)))
+	return buildFeed(feed, page), sc.categories(feed, page)
+}
+
+// matchItems returns the items of the feed that met the conditions and
+// the rules.
+func matchItems(feed *gofeed.Feed, t goql.Conditions, fr filterRules) []*gofeed.Item {
+	var items []*gofeed.Item
+	now := time.Now()
+	for _, item := range feed.Items {
+		if item == nil {
+			continue
+		}
+		if t != nil && len(t.Conditions()) > 0 {
+			b, err := checkItem(t, feed, item, now)
+			if err != nil {
+				log.Warn().Err(err).Interface("item", item).Msg("check item failed")
+			}
+			if !b {
+				continue
+			}
+		}
+		if len(fr) > 0 {
+			b, err := fr.check(feed, item, now)
+			if err != nil {
+				log.Warn().Err(err).Interface("item", item).Msg("check rules failed")
+			}
+			if !b {
+				continue
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// buildFeed returns a new feed with the metadata of the upstream feed
+// and the given items.
+func buildFeed(feed *gofeed.Feed, items []*gofeed.Item) *feeds.Feed {
+	var upd, pub time.Time
+	if feed.UpdatedParsed != nil {
+		upd = *feed.UpdatedParsed
+	}
+	if feed.PublishedParsed != nil {
+		pub = *feed.PublishedParsed
+	}
+
+	newFeed := &feeds.Feed{
+		Title:       feed.Title,
+		Link:        &feeds.Link{Href: feed.Link},
+		Description: feed.Description,
+		Author: &feeds.Author{
+			Name: "https://github.com/rverst/rss-filter",
+		},
+		Updated:   upd,
+		Created:   pub,
+		Items:     []*feeds.Item{},
+		Copyright: feed.Copyright,
+	}
+
+	for _, item := range items {
+		var pub, upd time.Time
+		var enc *feeds.Enclosure
+		if item.PublishedParsed != nil {
+			pub = *item.PublishedParsed
+		}
+		if item.UpdatedParsed != nil {
+			upd = *item.UpdatedParsed
+		}
+
+		// without a GUID and link the Atom ID would be random, the items
+		// would appear as new on every request
+		id := item.GUID
+		if id == "" && item.Link == "" {
+			id = "urn:sha1:" + itemKey(item)
+		}
+
+		if len(item.Enclosures) > 0 {
+			enc = new(feeds.Enclosure)
+			enc.Type = item.Enclosures[0].Type
+			enc.Url = item.Enclosures[0].URL
+			enc.Length = item.Enclosures[0].Length
+		}
+
+		newFeed.Items = append(newFeed.Items, &feeds.Item{
+			Title:       item.Title,
+			Link:        &feeds.Link{Href: item.Link},
+			Description: item.Description,
+			Id:          id,
+			Updated:     upd,
+			Created:     pub,
+			Content:     item.Content,
+			Enclosure:   enc,
+		})
+	}
+	return newFeed
+}
+
+// feedLink is an additional link of a generated feed, e.g. to a WebSub hub.
+type feedLink struct {
+	Rel  string
+	Href string
+}
+
+// atomFeed is an Atom feed whose entries have categories. gorilla/feeds
+// writes the category as text, Atom requires the term attribute.
+type atomFeed struct {
+	*feeds.AtomFeed
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	*feeds.AtomEntry
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func (f *atomFeed) FeedXml() interface{} {
+	return f
+}
+
+// newAtomFeed returns the Atom feed with the categories added to the
+// entries with the same index.
+func newAtomFeed(feed *feeds.Feed, categories []string) *atomFeed {
+	af := &atomFeed{AtomFeed: (&feeds.Atom{Feed: feed}).AtomFeed()}
+	for i, e := range af.AtomFeed.Entries {
+		entry := &atomEntry{AtomEntry: e}
+		if i < len(categories) {
+			entry.Categories = []atomCategory{{Term: categories[i]}}
+		}
+		af.Entries = append(af.Entries, entry)
+	}
+	return af
+}
+
+// renderFeed serializes the feed in the given format and returns it
+// together with its content type. categories are added to the items with
+// the same index, e.g. the score of an item.
+func renderFeed(feed *feeds.Feed, categories []string, fm format, links ...feedLink) (string, string, error) {
+	var body string
+	var err error
+	var cType = "application/xml"
+	switch fm {
+	case rss:
+		rf := (&feeds.Rss{Feed: feed}).RssFeed()
+		for i, c := range categories {
+			rf.Items[i].Category = c
+		}
+		body, err = feeds.ToXML(rf)
+	case atom:
+		body, err = feeds.ToXML(newAtomFeed(feed, categories))
+	case json:
+		jf := (&feeds.JSON{Feed: feed}).JSONFeed()
+		for i, c := range categories {
+			jf.Items[i].Tags = append(jf.Items[i].Tags, c)
+		}
+		for _, l := range links {
+			switch l.Rel {
+			case "hub":
+				jf.Hubs = append(jf.Hubs, &feeds.JSONHub{Type: "WebSub", Url: l.Href})
+			case "self":
+				jf.FeedUrl = l.Href
+			case "next":
+				jf.NextUrl = l.Href
+			}
+		}
+		body, err = jf.ToJSON()
+		cType = "application/json"
+		return body, cType, err
+	default:
+		err = fmt.Errorf("unsupported format: %s", fm)
+	}
+	if err != nil || len(links) == 0 {
+		return body, cType, err
+	}
+	return insertLinks(body, fm, links), cType, nil
+}
+
+// insertLinks adds the links as the first children of the <feed> element
+// of an Atom feed or as atom:link elements to the <channel> of an RSS feed.
+func insertLinks(body string, fm format, links []feedLink) string {
+	var element, ns, indent string
+	switch fm {
+	case atom:
+		element, indent = "link", "\n  "
+	case rss:
+		element, indent = "atom:link", "\n    "
+		ns = ` xmlns:atom="http://www.w3.org/2005/Atom"`
+	default:
+		return body
+	}
+
+	sb := strings.Builder{}
+	for _, l := range links {
+		sb.WriteString(indent + "<" + element + ns + ` href="`)
+		_ = xml.EscapeText(&sb, []byte(l.Href))
+		sb.WriteString(`" rel="`)
+		_ = xml.EscapeText(&sb, []byte(l.Rel))
+		sb.WriteString(`"></` + element + ">")
+	}
+	return insertChild(body, fm, sb.String())
+}
+
+// markArchive adds the fh:archive element of RFC 5005 that marks an
+// archive document, whose items don't change anymore.
+func markArchive(body string, fm format) string {
+	indent := "\n  "
+	if fm == rss {
+		indent = "\n    "
+	}
+	return insertChild(body, fm, indent+`<fh:archive xmlns:fh="http://purl.org/syndication/history/1.0"></fh:archive>`)
+}
+
+// insertChild inserts s after the start tag of the <feed> element of an
+// Atom feed or the <channel> of an RSS feed.
+func insertChild(body string, fm format, s string) string {
+	var open string
+	switch fm {
+	case atom:
+		open = "<feed"
+	case rss:
+		open = "<channel"
+	default:
+		return body
+	}
+
+	i := strings.Index(body, open)
+	if i < 0 {
+		return body
+	}
+	j := strings.Index(body[i:], ">")
+	if j < 0 {
+		return body
+	}
+	i += j + 1
+	return body[:i] + s + body[i:]
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/rverst/goql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// filterRule applies a filter to the items that match its if part, e.g.
+// if feed.Language startswith "de" then Title has word "Bonn".
+type filterRule struct {
+	rule string
+	when goql.Conditions
+	then goql.Conditions
+}
+
+// filterRules are checked in addition to the filter, an item is only kept
+// if it meets the then part of every rule whose if part it matches.
+type filterRules []filterRule
+
+// parseFilterRules parses rules like `if X then Y`, a rule may also contain
+// several rules on separate lines.
+func parseFilterRules(rules []string) (filterRules, error) {
+	var fr filterRules
+	for _, r := range rules {
+		for _, line := range strings.Split(r, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			rule, err := parseFilterRule(line)
+			if err != nil {
+				return nil, err
+			}
+			fr = append(fr, rule)
+		}
+	}
+	return fr, nil
+}
+
+func parseFilterRule(s string) (filterRule, error) {
+	rule := strings.TrimSpace(s)
+	p := newFilterParser(rule)
+	if w, n := p.peekWord(); strings.EqualFold(w, "if") {
+		p.pos += n
+	} else {
+		return filterRule{}, fmt.Errorf("rule must start with if: %s", rule)
+	}
+	when, ok, err := p.parseUntil("then")
+	if err == nil && !ok {
+		err = errors.New("then expected")
+	}
+	if err != nil {
+		return filterRule{}, fmt.Errorf("can't parse rule %s: %w", rule, err)
+	}
+	then, err := p.parse()
+	if err != nil {
+		return filterRule{}, fmt.Errorf("can't parse rule %s: %w", rule, err)
+	}
+	if len(when.Conditions()) == 0 || len(then.Conditions()) == 0 {
+		return filterRule{}, fmt.Errorf("rule without condition: %s", rule)
+	}
+	for _, t := range []goql.Conditions{when, then} {
+		if err := validateConditions(t); err != nil {
+			return filterRule{}, fmt.Errorf("can't parse rule %s: %w", rule, err)
+		}
+	}
+	return filterRule{rule: rule, when: when, then: then}, nil
+}
+
+// check reports whether the item meets the rules, an error stops the
+// evaluation like in checkItem.
+func (fr filterRules) check(feed *gofeed.Feed, item *gofeed.Item, now time.Time) (bool, error) {
+	for _, r := range fr {
+		m, err := checkItem(r.when, feed, item, now)
+		if err != nil {
+			return false, err
+		}
+		if !m {
+			continue
+		}
+		if m, err := checkItem(r.then, feed, item, now); err != nil || !m {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// queryFilterRules parses the rules parameters of the request.
+func queryFilterRules(r *http.Request) (filterRules, error) {
+	return parseFilterRules(queryValues(r, "rules"))
+}
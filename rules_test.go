@@ -0,0 +1,129 @@
+package main
+
+import (
+	encjson "encoding/json"
+	"github.com/mmcdole/gofeed"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilterRules(t *testing.T) {
+	tests := []struct {
+		rules   []string
+		want    int
+		wantErr bool
+	}{
+		{nil, 0, false},
+		{[]string{"", "  "}, 0, false},
+		{[]string{`if feed.Language == "de" then Title has word "Bonn"`}, 1, false},
+		{[]string{"IF feed.FeedType == rss THEN Title ~= \"a\" | Title ~= \"then\"\n\nif Link contains x then not Title == y & Title == z"}, 2, false},
+		{[]string{`feed.Language == "de" then Title ~= "Bonn"`}, 0, true},
+		{[]string{`if feed.Language == "de" Title ~= "Bonn"`}, 0, true},
+		{[]string{`if then Title ~= "Bonn"`}, 0, true},
+		{[]string{`if feed.Language == "de" then`}, 0, true},
+		{[]string{`if feed.Language == then Title ~= "Bonn"`}, 0, true},
+		{[]string{`if feed.Items == "" then Title ~= "Bonn"`}, 0, true},
+		{[]string{`if feed.Unknown == "de" then Title ~= "Bonn"`}, 0, true},
+	}
+	for _, tt := range tests {
+		fr, err := parseFilterRules(tt.rules)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.rules)
+			}
+			continue
+		}
+		if err != nil || len(fr) != tt.want {
+			t.Errorf("%q: got %d rules, %v, want %d", tt.rules, len(fr), err, tt.want)
+		}
+	}
+}
+
+func TestFeedFields(t *testing.T) {
+	pub := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	feed := &gofeed.Feed{Title: "Stadtnachrichten", Language: "de-DE", FeedType: "rss", PublishedParsed: &pub}
+	item := &gofeed.Item{Title: "Bonn"}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`feed.Title == "stadtnachrichten"`, true},
+		{`FEED.Language startswith "de"`, true},
+		{`feed.FeedType in ("atom", "json")`, false},
+		{`feed.PublishedParsed > now-2d`, true},
+		{`lower(feed.Title) contains "nachricht" & Title == "Bonn"`, true},
+	}
+	for _, tt := range tests {
+		got, err := checkItem(mustParseFilter(t, tt.filter), feed, item, pub)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %t, %v, want %t", tt.filter, got, err, tt.want)
+		}
+	}
+	if _, err := checkItem(mustParseFilter(t, `feed.Title == "a"`), nil, item, pub); err == nil {
+		t.Error("feed field without a feed: expected an error")
+	}
+	if _, err := checkItem(mustParseFilter(t, `feed.UpdatedParsed < now`), feed, item, pub); err == nil {
+		t.Error("feed without update date: expected an error")
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	upstream, h := newTestServer(t)
+	rules := []string{`if feed.Title == "City news" then Title ~= "Bonn"`, `if feed.FeedType == atom then Title startswith "Release"`}
+	tests := []struct {
+		feed string
+		rule []string
+		want []string
+	}{
+		{"rss20.xml", rules, []string{"Bonn opens new bridge", "Sports: Bonn wins"}},
+		{"atom10.xml", rules, []string{"Release 1.0", "Release 1.0.1"}},
+		{"rss20.xml", []string{`if Link contains "sports" then Title ~= "Cologne"`}, []string{"Bonn opens new bridge", "Breaking: Cologne cathedral closed"}},
+	}
+	for _, tt := range tests {
+		rec := request(t, h, url.Values{"feed_url": {upstream.URL + "/" + tt.feed}, "rules": tt.rule})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.feed, rec.Code, rec.Body.String())
+		}
+		if got := titles(t, rec.Body.String()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %q: got %q, want %q", tt.feed, tt.rule, got, tt.want)
+		}
+	}
+
+	rec := request(t, h, url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "rules": {`if feed.Title == "x"`}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("rule without then: status %d", rec.Code)
+	}
+
+	rec = requestPath(t, h, "/explain", url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "filter": {`Title ~! "^Sports"`}, "rules": rules})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var e explanation
+	if err := encjson.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ItemsKept != 1 || len(e.Rules) != 2 {
+		t.Fatalf("unexpected explanation: %s", rec.Body.String())
+	}
+	if ie := e.Items[1]; ie.Kept || ie.DecidedBy != rules[0] || !ie.Rules[0].Applied || ie.Rules[0].Matched || ie.Rules[1].Applied {
+		t.Errorf("cathedral: %+v", ie)
+	}
+	if ie := e.Items[2]; ie.Kept || !strings.HasPrefix(ie.DecidedBy, "Title") {
+		t.Errorf("sports: %+v", ie)
+	}
+
+	fc := &feedConfig{Name: "news", URL: upstream.URL + "/rss20.xml", Rules: rules[:1]}
+	if err := fc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	f := newFetcher(0)
+	named := newRssHandler("", "", true, f, newStaleCache(0), newScheduler(f, nil, []*feedConfig{fc}, defaultHostLimit, 5*time.Second), nil, 5*time.Second, "")
+	rec = requestPath(t, named, "/feeds/news", nil)
+	if got := titles(t, rec.Body.String()); !reflect.DeepEqual(got, []string{"Bonn opens new bridge", "Sports: Bonn wins"}) {
+		t.Errorf("named feed: got %q", got)
+	}
+}
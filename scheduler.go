@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/mmcdole/gofeed"
+	rssparser "github.com/mmcdole/gofeed/rss"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHostLimit = 2
+	maxInterval      = 24 * time.Hour
+	maxStartDelay    = 30 * time.Second
+)
+
+// feedState is the result of the latest polls of a named feed.
+type feedState struct {
+	body        []byte
+	contentType string
+	fetched     time.Time
+	attempted   time.Time
+	status      int
+	itemsIn     int
+	itemsKept   int
+	err         error
+	next        time.Time
+
+	// feed is the upstream feed without its items, for rendering the
+	// pages of the archive. items are the items of the upstream feed,
+	// content pushed by a hub is merged into them.
+	feed  *gofeed.Feed
+	items []*gofeed.Item
+}
+
+// scheduler polls the named feeds on their own interval, filters them
+// and keeps the result in memory. Feeds can be added, replaced and
+// removed while it is running.
+type scheduler struct {
+	fetcher   *fetcher
+	store     *itemStore
+	websub    *websub
+	notifier  *notifier
+	hostLimit int
+	timeout   time.Duration
+	baseUrl   string
+
+	mu      sync.RWMutex
+	ctx     context.Context
+	feeds   map[string]*feedConfig
+	cancels map[string]context.CancelFunc
+	states  map[string]*feedState
+	hosts   map[string]chan struct{}
+	locks   map[string]*sync.Mutex
+	warm    bool
+	wg      sync.WaitGroup
+}
+
+func newScheduler(fetcher *fetcher, store *itemStore, feeds []*feedConfig, hostLimit int, timeout time.Duration) *scheduler {
+	s := &scheduler{
+		fetcher:   fetcher,
+		store:     store,
+		notifier:  newNotifier(store),
+		hostLimit: hostLimit,
+		timeout:   timeout,
+		feeds:     map[string]*feedConfig{},
+		cancels:   map[string]context.CancelFunc{},
+		states:    map[string]*feedState{},
+		hosts:     map[string]chan struct{}{},
+		locks:     map[string]*sync.Mutex{},
+	}
+	for _, fc := range feeds {
+		s.feeds[fc.Name] = fc
+	}
+	return s
+}
+
+// start begins polling all feeds until ctx is done, feeds that are set
+// later are polled until then as well.
+func (s *scheduler) start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	for _, fc := range s.feeds {
+		s.startFeed(fc, true)
+	}
+}
+
+// startFeed starts the poller of the feed, s.mu must be held.
+func (s *scheduler) startFeed(fc *feedConfig, spread bool) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.cancels[fc.Name] = cancel
+	s.wg.Add(1)
+	go s.run(ctx, fc, spread)
+}
+
+// stopFeed stops the poller of the feed and drops its state, s.mu must
+// be held.
+func (s *scheduler) stopFeed(name string) {
+	if cancel, ok := s.cancels[name]; ok {
+		cancel()
+		delete(s.cancels, name)
+	}
+	delete(s.states, name)
+}
+
+// feed returns the config of the named feed.
+func (s *scheduler) feed(name string) (*feedConfig, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fc, ok := s.feeds[name]
+	return fc, ok
+}
+
+// list returns the configs of all feeds sorted by name.
+func (s *scheduler) list() []*feedConfig {
+	s.mu.RLock()
+	list := make([]*feedConfig, 0, len(s.feeds))
+	for _, fc := range s.feeds {
+		list = append(list, fc)
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// set adds the feed or replaces the feed with the same name, a replaced
+// feed starts over with a new poll. fc must be validated.
+func (s *scheduler) set(fc *feedConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setFeed(fc, false)
+}
+
+// setAll sets the feeds like set, but spreads their first polls like
+// after a restart, so a bulk import doesn't poll all of them at once.
+func (s *scheduler) setAll(feeds []*feedConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fc := range feeds {
+		s.setFeed(fc, true)
+	}
+}
+
+// setFeed adds or replaces the feed, s.mu must be held.
+func (s *scheduler) setFeed(fc *feedConfig, spread bool) {
+	s.stopFeed(fc.Name)
+	s.feeds[fc.Name] = fc
+	if s.ctx != nil {
+		s.startFeed(fc, spread)
+	}
+}
+
+// remove stops polling the named feed and drops it.
+func (s *scheduler) remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.feeds[name]; !ok {
+		return false
+	}
+	s.stopFeed(name)
+	delete(s.feeds, name)
+	return true
+}
+
+// refresh polls the named feed now, regardless of its next poll.
+func (s *scheduler) refresh(ctx context.Context, name string) (*feedState, bool) {
+	fc, ok := s.feed(name)
+	if !ok {
+		return nil, false
+	}
+	s.poll(ctx, fc, true)
+	return s.state(name), true
+}
+
+// wait blocks until the pollers are stopped and pending pushes and
+// notifications are done, or ctx is done.
+func (s *scheduler) wait(ctx context.Context) error {
+	return waitGroup(ctx, &s.wg)
+}
+
+// waitGroup waits for wg until ctx is done.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *scheduler) run(ctx context.Context, fc *feedConfig, spread bool) {
+	defer s.wg.Done()
+
+	// spread the first polls, so we don't hit the same server with
+	// all feeds at once after a restart
+	var delay time.Duration
+	if spread {
+		start := time.Duration(fc.Interval)
+		if start > maxStartDelay {
+			start = maxStartDelay
+		}
+		delay = time.Duration(rand.Int63n(int64(start)))
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(s.poll(ctx, fc, false))
+	}
+}
+
+// get returns the state of the named feed. If the feed was not polled
+// yet, it is polled immediately.
+func (s *scheduler) get(ctx context.Context, name string) (*feedState, bool) {
+	fc, ok := s.feed(name)
+	if !ok {
+		return nil, false
+	}
+	if st := s.state(name); st != nil {
+		cacheRequests.inc("named", "hit")
+		return st, true
+	}
+	cacheRequests.inc("named", "miss")
+	s.poll(ctx, fc, false)
+	return s.state(name), true
+}
+
+// state returns a copy of the state of the named feed, or nil if it
+// was not polled yet.
+func (s *scheduler) state(name string) *feedState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st, ok := s.states[name]
+	if !ok {
+		return nil
+	}
+	c := *st
+	return &c
+}
+
+// ready reports whether all named feeds were polled at least once.
+// Feeds that are added later don't make it unready again.
+func (s *scheduler) ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.warm {
+		s.warm = len(s.states) >= len(s.feeds)
+	}
+	return s.warm
+}
+
+// lock returns the lock that serializes polls and pushes of the feed.
+func (s *scheduler) lock(name string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.locks[name]
+	if !ok {
+		l = new(sync.Mutex)
+		s.locks[name] = l
+	}
+	return l
+}
+
+// poll fetches and filters the feed and stores the result, unless force
+// is false and a poll that finished in the meantime made it unnecessary.
+// It returns the delay until the next poll.
+func (s *scheduler) poll(ctx context.Context, fc *feedConfig, force bool) time.Duration {
+	lock := s.lock(fc.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// another poll might have finished while we were waiting for the lock
+	if st := s.state(fc.Name); !force && st != nil && st.err == nil && time.Now().Before(st.next) {
+		return time.Until(st.next)
+	}
+
+	timeout := s.timeout
+	if fc.Timeout > 0 {
+		timeout = time.Duration(fc.Timeout)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ctx, sp := startSpan(withNamedFeed(ctx), "poll "+fc.Name, spanKindInternal)
+	defer sp.finish()
+	sp.set("rss_filter.pipeline", fc.Name)
+
+	release, err := s.acquire(ctx, fc.URL)
+	if err != nil {
+		return time.Duration(fc.Interval)
+	}
+	up, err := s.fetcher.fetch(ctx, fc.URL, fc.User, fc.Password)
+	release()
+
+	if err == nil && s.websub != nil {
+		s.websub.discover(ctx, fc, up)
+	}
+	sp.fail(err)
+	return s.update(ctx, fc, up, err)
+}
+
+// push processes content that was pushed by a WebSub hub in the
+// background. A hub may push only the new items, so they are merged
+// into the items of the latest poll.
+func (s *scheduler) push(fc *feedConfig, up *upstream) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		lock := s.lock(fc.Name)
+		lock.Lock()
+		defer lock.Unlock()
+		ctx, sp := startSpan(context.Background(), "push "+fc.Name, spanKindInternal)
+		defer sp.finish()
+		sp.set("rss_filter.pipeline", fc.Name)
+		if st := s.state(fc.Name); st != nil {
+			up.feed.Items = mergeItems(up.feed.Items, st.items)
+		}
+		s.update(ctx, fc, up, nil)
+	}()
+}
+
+// mergeItems returns the pushed items followed by the current items that
+// were not pushed again. Like an upstream feed that shows only its latest
+// items, the result doesn't grow beyond the longer of both lists.
+func mergeItems(pushed, current []*gofeed.Item) []*gofeed.Item {
+	n := len(current)
+	if len(pushed) > n {
+		n = len(pushed)
+	}
+	seen := map[string]bool{}
+	items := make([]*gofeed.Item, 0, n)
+	for _, item := range pushed {
+		seen[itemKey(item)] = true
+		items = append(items, item)
+	}
+	for _, item := range current {
+		if len(items) >= n {
+			break
+		}
+		if !seen[itemKey(item)] {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// update filters the upstream feed and stores the result, err is the
+// error that occurred while fetching it. It returns the delay until the
+// next poll.
+func (s *scheduler) update(ctx context.Context, fc *feedConfig, up *upstream, err error) time.Duration {
+	interval := time.Duration(fc.Interval)
+	var body, cType string
+	var status, itemsIn, itemsKept int
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		status = ue.StatusCode
+	}
+	if err == nil {
+		status = up.status
+		interval = pollInterval(interval, up)
+		var links []feedLink
+		if s.websub != nil {
+			if d := s.websub.pollInterval(fc.Name); d > interval {
+				interval = d
+			}
+			links = s.websub.links(fc.Name)
+		}
+
+		fm := resolveFormat(parseFormat(fc.Out), up.feed)
+		_, sp := startSpan(ctx, "filter", spanKindInternal)
+		matched := fc.scoring.keep(up.feed, matchItems(up.feed, fc.conditions, fc.rules))
+		sp.set("rss_filter.items_in", len(up.feed.Items))
+		sp.set("rss_filter.items_kept", len(matched))
+		sp.finish()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.notifier.notify(fc, matched)
+		}()
+
+		var items []*gofeed.Item
+		items, err = s.history(fc, matched)
+		page := fc.listOptions().apply(items)
+		newFeed := buildFeed(up.feed, page)
+		if err == nil {
+			var pages uint64
+			if pages, err = s.archivePages(fc); pages > 0 {
+				links = append(links, feedLink{Rel: "prev-archive", Href: s.archiveUrl(fc.Name, pages)})
+			}
+		}
+		if err == nil {
+			_, sp = startSpan(ctx, "render", spanKindInternal)
+			body, cType, err = renderFeed(newFeed, fc.scoring.categories(up.feed, page), fm, links...)
+			sp.set("rss_filter.format", string(fm))
+			sp.set("rss_filter.bytes", len(body))
+			sp.fail(err)
+			sp.finish()
+		}
+		if err == nil {
+			itemsIn, itemsKept = len(up.feed.Items), len(matched)
+			countItems(fc.Name, itemsIn, itemsKept)
+			log.Debug().Str("feed", fc.Name).Str("format", string(fm)).Int("original_items", len(up.feed.Items)).Int("kept_items", len(newFeed.Items)).Msg("feed polled")
+		}
+	}
+	interval = jitter(interval)
+
+	s.mu.Lock()
+	if s.feeds[fc.Name] != fc {
+		// the feed was replaced or removed during the poll
+		s.mu.Unlock()
+		return interval
+	}
+	st := s.states[fc.Name]
+	if st == nil {
+		st = new(feedState)
+		s.states[fc.Name] = st
+	}
+	st.err = err
+	st.status = status
+	st.attempted = time.Now()
+	st.next = time.Now().Add(interval)
+	if err != nil {
+		s.mu.Unlock()
+		log.Err(err).Str("feed", fc.Name).Dur("next", interval).Msg("polling of feed failed")
+		return interval
+	}
+	changed := st.body != nil && body != string(st.body)
+	data := []byte(body)
+	st.body = data
+	st.contentType = cType
+	st.fetched = time.Now()
+	st.itemsIn = itemsIn
+	st.itemsKept = itemsKept
+	meta := *up.feed
+	meta.Items = nil
+	st.feed = &meta
+	st.items = up.feed.Items
+	s.mu.Unlock()
+
+	if changed && s.websub != nil {
+		s.websub.publish(fc.Name, data, cType)
+	}
+	return interval
+}
+
+// history stores the kept items of a feed that keeps its history and
+// returns the items of the history, otherwise the items are returned
+// unchanged.
+func (s *scheduler) history(fc *feedConfig, items []*gofeed.Item) ([]*gofeed.Item, error) {
+	if s.store == nil || !fc.keepsHistory() {
+		return items, nil
+	}
+	if err := s.store.save(fc.Name, items); err != nil {
+		return nil, err
+	}
+	return s.store.history(fc.Name, fc.HistoryItems, time.Duration(fc.HistoryDays)*24*time.Hour, fc.Limit, fc.ArchivePages)
+}
+
+// acquire blocks until a slot for the host of feedUrl is free, the
+// returned function releases the slot.
+func (s *scheduler) acquire(ctx context.Context, feedUrl string) (func(), error) {
+	host := feedUrl
+	if u, err := url.Parse(feedUrl); err == nil {
+		host = u.Host
+	}
+
+	s.mu.Lock()
+	sem, ok := s.hosts[host]
+	if !ok {
+		limit := s.hostLimit
+		if limit <= 0 {
+			limit = 1
+		}
+		sem = make(chan struct{}, limit)
+		s.hosts[host] = sem
+	}
+	s.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pollInterval returns the configured interval, or a longer one if the
+// upstream asks not to be polled that often via <ttl>, sy:updatePeriod
+// or the Cache-Control header.
+func pollInterval(configured time.Duration, up *upstream) time.Duration {
+	d := configured
+	for _, hint := range []time.Duration{rssTTL(up), syndicationPeriod(up), cacheLifetime(up.header)} {
+		if hint > d {
+			d = hint
+		}
+	}
+	if d > maxInterval {
+		d = maxInterval
+	}
+	return d
+}
+
+// jitter randomizes d by ±10%.
+func jitter(d time.Duration) time.Duration {
+	j := int64(d) / 10
+	if j <= 0 {
+		return d
+	}
+	return d - time.Duration(j) + time.Duration(rand.Int63n(2*j+1))
+}
+
+// rssTTL returns the <ttl> of an RSS feed.
+func rssTTL(up *upstream) time.Duration {
+	if up.feed.FeedType != "rss" {
+		return 0
+	}
+	f, err := (&rssparser.Parser{}).Parse(bytes.NewReader(up.body))
+	if err != nil {
+		return 0
+	}
+	ttl, err := strconv.Atoi(strings.TrimSpace(f.TTL))
+	if err != nil || ttl <= 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Minute
+}
+
+// syndicationPeriod returns the update period of the RSS syndication
+// module (sy:updatePeriod and sy:updateFrequency).
+func syndicationPeriod(up *upstream) time.Duration {
+	sy, ok := up.feed.Extensions["sy"]
+	if !ok {
+		return 0
+	}
+	var period time.Duration
+	if e := sy["updatePeriod"]; len(e) > 0 {
+		switch strings.ToLower(strings.TrimSpace(e[0].Value)) {
+		case "hourly":
+			period = time.Hour
+		case "daily":
+			period = 24 * time.Hour
+		case "weekly":
+			period = 7 * 24 * time.Hour
+		case "monthly":
+			period = 30 * 24 * time.Hour
+		case "yearly":
+			period = 365 * 24 * time.Hour
+		}
+	}
+	if period == 0 {
+		return 0
+	}
+	if e := sy["updateFrequency"]; len(e) > 0 {
+		if f, err := strconv.Atoi(strings.TrimSpace(e[0].Value)); err == nil && f > 0 {
+			period /= time.Duration(f)
+		}
+	}
+	return period
+}
+
+// cacheLifetime returns the freshness lifetime of a response given by
+// the max-age directive of Cache-Control or the Expires header.
+func cacheLifetime(h http.Header) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(k, "max-age") {
+			if s, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil && s > 0 {
+				return time.Duration(s) * time.Second
+			}
+			return 0
+		}
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPollInterval(t *testing.T) {
+	rss := func(channel string) string {
+		return `<?xml version="1.0"?>
+<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/"><channel><title>News</title>` + channel + `</channel></rss>`
+	}
+	tests := []struct {
+		name       string
+		body       string
+		header     http.Header
+		configured time.Duration
+		want       time.Duration
+	}{
+		{"no hints", rss(""), nil, 15 * time.Minute, 15 * time.Minute},
+		{"ttl", rss("<ttl>60</ttl>"), nil, 15 * time.Minute, time.Hour},
+		{"shorter ttl", rss("<ttl>5</ttl>"), nil, 15 * time.Minute, 15 * time.Minute},
+		{"invalid ttl", rss("<ttl>soon</ttl>"), nil, 15 * time.Minute, 15 * time.Minute},
+		{"update period", rss("<sy:updatePeriod>hourly</sy:updatePeriod>"), nil, 15 * time.Minute, time.Hour},
+		{"update frequency", rss("<sy:updatePeriod>daily</sy:updatePeriod><sy:updateFrequency>4</sy:updateFrequency>"), nil, 15 * time.Minute, 6 * time.Hour},
+		{"unknown update period", rss("<sy:updatePeriod>often</sy:updatePeriod>"), nil, 15 * time.Minute, 15 * time.Minute},
+		{"max-age", rss(""), http.Header{"Cache-Control": {"public, max-age=1800"}}, 15 * time.Minute, 30 * time.Minute},
+		{"no max-age", rss(""), http.Header{"Cache-Control": {"no-cache"}}, 15 * time.Minute, 15 * time.Minute},
+		{"longest hint", rss("<ttl>120</ttl><sy:updatePeriod>hourly</sy:updatePeriod>"), http.Header{"Cache-Control": {"max-age=60"}}, 15 * time.Minute, 2 * time.Hour},
+		{"capped", rss("<sy:updatePeriod>weekly</sy:updatePeriod>"), nil, 15 * time.Minute, maxInterval},
+		{"atom ignores ttl", `<feed xmlns="http://www.w3.org/2005/Atom"><title>News</title><ttl>60</ttl></feed>`, nil, 15 * time.Minute, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			feed, err := parseFeed([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			up := &upstream{feed: feed, header: header, body: []byte(tt.body)}
+			if got := pollInterval(tt.configured, up); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	h := http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}
+	if d := cacheLifetime(h); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expires: got %s", d)
+	}
+	h.Set("Cache-Control", "max-age=0")
+	if d := cacheLifetime(h); d != 0 {
+		t.Errorf("max-age takes precedence over expires: got %s", d)
+	}
+	if d := cacheLifetime(http.Header{"Expires": {"0"}}); d != 0 {
+		t.Errorf("invalid expires: got %s", d)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, d := range []time.Duration{0, 5, time.Minute, time.Hour} {
+		for i := 0; i < 50; i++ {
+			if got := jitter(d); got < d-d/10 || got > d+d/10 {
+				t.Errorf("%s: got %s", d, got)
+			}
+		}
+	}
+}
+
+func TestHostLimit(t *testing.T) {
+	s := newScheduler(newFetcher(0), nil, nil, 2, 0)
+	ctx := context.Background()
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := s.acquire(ctx, "https://example.org/feed"+string(rune('a'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(short, "https://example.org/feedc"); err == nil {
+		t.Fatal("third poll of the same host: expected to block")
+	}
+	release, err := s.acquire(ctx, "https://example.com/feed")
+	if err != nil {
+		t.Fatalf("other host: %v", err)
+	}
+	release()
+
+	releases[0]()
+	short, cancel = context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	release, err = s.acquire(short, "https://example.org/feedc")
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	release()
+	releases[1]()
+}
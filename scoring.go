@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/rs/zerolog/log"
+	"github.com/rverst/goql"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scoreRule adds its weight to the score of the items that meet its
+// conditions.
+type scoreRule struct {
+	rule       string
+	conditions goql.Conditions
+	weight     float64
+}
+
+// scoring keeps the items whose score, the sum of the weights of the
+// rules they meet, is above the threshold.
+type scoring struct {
+	rules     []scoreRule
+	threshold float64
+	show      bool
+}
+
+// parseScoring parses rules like `Title ~= "Bonn" => +5`, a rule may also
+// contain several rules on separate lines. It returns nil if there are no
+// rules, all items are kept then.
+func parseScoring(rules []string, threshold float64, show bool) (*scoring, error) {
+	sc := &scoring{threshold: threshold, show: show}
+	for _, r := range rules {
+		for _, line := range strings.Split(r, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			rule, err := parseRule(line)
+			if err != nil {
+				return nil, err
+			}
+			sc.rules = append(sc.rules, rule)
+		}
+	}
+	if len(sc.rules) == 0 {
+		return nil, nil
+	}
+	return sc, nil
+}
+
+func parseRule(s string) (scoreRule, error) {
+	i := strings.LastIndex(s, "=>")
+	if i < 0 {
+		return scoreRule{}, fmt.Errorf("rule without weight: %s", s)
+	}
+	expr := strings.TrimSpace(s[:i])
+	if expr == "" {
+		return scoreRule{}, fmt.Errorf("rule without condition: %s", s)
+	}
+	w, err := strconv.ParseFloat(strings.TrimSpace(s[i+2:]), 64)
+	if err != nil || math.IsNaN(w) || math.IsInf(w, 0) {
+		return scoreRule{}, fmt.Errorf("invalid weight: %s", s)
+	}
+	t, err := parseFilter(expr)
+	if err != nil {
+		return scoreRule{}, fmt.Errorf("can't parse rule %s: %w", expr, err)
+	}
+	return scoreRule{rule: expr, conditions: t, weight: w}, nil
+}
+
+// score returns the score of the item, rules that fail to evaluate don't
+// count.
+func (sc *scoring) score(feed *gofeed.Feed, item *gofeed.Item) float64 {
+	var score float64
+	now := time.Now()
+	for _, r := range sc.rules {
+		m, err := checkItem(r.conditions, feed, item, now)
+		if err != nil {
+			log.Warn().Err(err).Str("rule", r.rule).Interface("item", item).Msg("check rule failed")
+		}
+		if m {
+			score += r.weight
+		}
+	}
+	return score
+}
+
+// keep returns the items with a score above the threshold, or all items
+// if sc is nil.
+func (sc *scoring) keep(feed *gofeed.Feed, items []*gofeed.Item) []*gofeed.Item {
+	if sc == nil {
+		return items
+	}
+	var kept []*gofeed.Item
+	for _, item := range items {
+		if sc.score(feed, item) > sc.threshold {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// categories returns a category with the score for every item if the
+// score should be shown, nil otherwise.
+func (sc *scoring) categories(feed *gofeed.Feed, items []*gofeed.Item) []string {
+	if sc == nil || !sc.show {
+		return nil
+	}
+	list := make([]string, len(items))
+	for i, item := range items {
+		list[i] = scoreCategory(sc.score(feed, item))
+	}
+	return list
+}
+
+func scoreCategory(score float64) string {
+	return "score:" + strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// queryScoring parses the score, threshold and show_score parameters of
+// the request.
+func queryScoring(r *http.Request) (*scoring, error) {
+	threshold, err := parseThreshold(queryValue(r, "threshold"))
+	if err != nil {
+		return nil, err
+	}
+	show, _ := strconv.ParseBool(queryValue(r, "show_score"))
+	return parseScoring(queryValues(r, "score"), threshold, show)
+}
+
+// parseThreshold parses a threshold, an empty value is 0.
+func parseThreshold(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(t) {
+		return 0, errors.New("invalid threshold: " + s)
+	}
+	return t, nil
+}
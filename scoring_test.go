@@ -0,0 +1,171 @@
+package main
+
+import (
+	encjson "encoding/json"
+	"github.com/gorilla/feeds"
+	"github.com/mmcdole/gofeed"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScoring(t *testing.T) {
+	tests := []struct {
+		rules   []string
+		weights []float64
+		wantErr bool
+	}{
+		{nil, nil, false},
+		{[]string{"", "  "}, nil, false},
+		{[]string{`Title ~= "Bonn" => +5`}, []float64{5}, false},
+		{[]string{`Title ~= "Bonn" => +5`, `Link ~= "sports" => -10`}, []float64{5, -10}, false},
+		{[]string{"Title ~= \"Bonn\" => 1.5\n\nLink ~= \"a=>b\" => -2"}, []float64{1.5, -2}, false},
+		{[]string{`Title ~= "Bonn"`}, nil, true},
+		{[]string{`=> 5`}, nil, true},
+		{[]string{`Title ~= "Bonn" => five`}, nil, true},
+		{[]string{`Title ~= "Bonn" => NaN`}, nil, true},
+		{[]string{`Title ~= => 5`}, nil, true},
+	}
+	for _, tt := range tests {
+		sc, err := parseScoring(tt.rules, 0, false)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.rules)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.rules, err)
+			continue
+		}
+		var weights []float64
+		if sc != nil {
+			for _, r := range sc.rules {
+				weights = append(weights, r.weight)
+			}
+		}
+		if !reflect.DeepEqual(weights, tt.weights) {
+			t.Errorf("%q: got weights %v, want %v", tt.rules, weights, tt.weights)
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	upstream, h := newTestServer(t)
+	rules := []string{`Title ~= "Bonn" => +5`, "Link ~= \"sports\" => -10\nTitle ~= \"bridge\" => 0.5"}
+	tests := []struct {
+		filter    string
+		threshold string
+		want      []string
+	}{
+		{``, ``, []string{"Bonn opens new bridge"}},
+		{``, `-6`, []string{"Bonn opens new bridge", "Breaking: Cologne cathedral closed", "Sports: Bonn wins"}},
+		{``, `-1`, []string{"Bonn opens new bridge", "Breaking: Cologne cathedral closed"}},
+		{`Title ~= "Cologne"`, `-1`, []string{"Breaking: Cologne cathedral closed"}},
+		{``, `6`, []string{}},
+	}
+	for _, tt := range tests {
+		for _, out := range []string{"rss", "atom", "json"} {
+			rec := request(t, h, url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "filter": {tt.filter}, "score": rules, "threshold": {tt.threshold}, "out": {out}})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: status %d: %s", out, rec.Code, rec.Body.String())
+			}
+			if got := titles(t, rec.Body.String()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s %s > %s: got %q, want %q", out, tt.filter, tt.threshold, got, tt.want)
+			}
+		}
+	}
+
+	rec := request(t, h, url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "score": {`Title ~= "Bonn" => 5`}, "threshold": {"x"}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid threshold: status %d", rec.Code)
+	}
+	rec = request(t, h, url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "score": {`Title ~= "Bonn"`}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("rule without weight: status %d", rec.Code)
+	}
+}
+
+func TestShowScore(t *testing.T) {
+	upstream, h := newTestServer(t)
+	for _, out := range []string{"rss", "atom", "json"} {
+		rec := request(t, h, url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "score": {`Title ~= "Bonn" => 5`, `Title ~= "bridge" => -0.5`},
+			"show_score": {"1"}, "out": {out}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", out, rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), "score:4.5") || !strings.Contains(rec.Body.String(), "score:5") {
+			t.Errorf("%s: no scores in output:\n%s", out, rec.Body.String())
+		}
+		if out == "atom" && !strings.Contains(rec.Body.String(), `<category term="score:4.5"></category>`) {
+			t.Errorf("atom: category without term:\n%s", rec.Body.String())
+		}
+		feed, err := gofeed.NewParser().ParseString(rec.Body.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := feed.Items[0].Categories; !reflect.DeepEqual(got, []string{"score:4.5"}) {
+			t.Errorf("%s: got categories %q", out, got)
+		}
+	}
+}
+
+func TestAtomCategory(t *testing.T) {
+	feed := &feeds.Feed{Title: "news", Link: &feeds.Link{Href: "https://example.org/"}, Updated: time.Now()}
+	for _, title := range []string{"a", "b", "c"} {
+		feed.Items = append(feed.Items, &feeds.Item{Title: title, Link: &feeds.Link{Href: "https://example.org/" + title}, Updated: time.Now()})
+	}
+	tests := [][]string{
+		{"score:4.5", "score:-0.5", "score:0"},
+		{`a<b & "c"`, "</category>", "x'y>"},
+		{"score:1"},
+		nil,
+	}
+	for _, categories := range tests {
+		body, _, err := renderFeed(feed, categories, atom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := gofeed.NewParser().ParseString(body)
+		if err != nil {
+			t.Fatalf("%q: %s", categories, err)
+		}
+		for i, item := range parsed.Items {
+			var want []string
+			if i < len(categories) {
+				want = []string{categories[i]}
+			}
+			if !reflect.DeepEqual(item.Categories, want) {
+				t.Errorf("%q: item %d: got categories %q, want %q", categories, i, item.Categories, want)
+			}
+		}
+	}
+}
+
+func TestExplainScore(t *testing.T) {
+	upstream, h := newTestServer(t)
+	rec := requestPath(t, h, "/explain", url.Values{"feed_url": {upstream.URL + "/rss20.xml"}, "filter": {`Title ~! "^Breaking"`},
+		"score": {`Title ~= "Bonn" => 5`, `Link ~= "sports" => -10`}, "threshold": {"-1"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var e explanation
+	if err := encjson.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ItemsIn != 3 || e.ItemsKept != 1 || len(e.ScoreRules) != 2 || e.Threshold == nil || *e.Threshold != -1 {
+		t.Fatalf("unexpected explanation: %s", rec.Body.String())
+	}
+	if ie := e.Items[0]; !ie.Kept || ie.Score == nil || *ie.Score != 5 {
+		t.Errorf("bridge: %+v", ie)
+	}
+	if ie := e.Items[1]; ie.Kept || ie.Score == nil || *ie.Score != 0 || ie.DecidedBy != `Title ~! "^Breaking"` {
+		t.Errorf("cathedral: %+v", ie)
+	}
+	if ie := e.Items[2]; ie.Kept || ie.Score == nil || *ie.Score != -5 || !ie.ScoreRules[1].Matched || !strings.HasPrefix(ie.DecidedBy, "score -5") {
+		t.Errorf("sports: %+v", ie)
+	}
+}
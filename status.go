@@ -0,0 +1,89 @@
+package main
+
+import (
+	encjson "encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// feedStatus is the status of a named feed as reported by /status.
+type feedStatus struct {
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	LastFetch   *time.Time `json:"last_fetch,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastStatus  int        `json:"last_status,omitempty"`
+	ItemsIn     int        `json:"items_in"`
+	ItemsKept   int        `json:"items_kept"`
+	CacheAge    *float64   `json:"cache_age_seconds,omitempty"`
+	NextPoll    *time.Time `json:"next_poll,omitempty"`
+}
+
+// serveHealthz reports that the process is alive.
+func serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// serveReadyz reports whether the named feeds were polled at least
+// once, so requests can be served from memory.
+func (s *scheduler) serveReadyz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !s.ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("not ready"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+// serveStatus lists the state of all named feeds as JSON.
+func (s *scheduler) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	list := []feedStatus{}
+	for _, fc := range s.list() {
+		list = append(list, s.status(fc))
+	}
+
+	data, err := encjson.MarshalIndent(map[string]interface{}{"feeds": list}, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// status returns the status of the feed.
+func (s *scheduler) status(fc *feedConfig) feedStatus {
+	fs := feedStatus{Name: fc.Name, URL: redactUrl(fc.URL)}
+	if st := s.state(fc.Name); st != nil {
+		fs.LastFetch = &st.attempted
+		fs.LastStatus = st.status
+		fs.ItemsIn = st.itemsIn
+		fs.ItemsKept = st.itemsKept
+		fs.NextPoll = &st.next
+		if st.err != nil {
+			fs.LastError = st.err.Error()
+		}
+		if !st.fetched.IsZero() {
+			age := time.Since(st.fetched).Seconds()
+			fs.LastSuccess = &st.fetched
+			fs.CacheAge = &age
+		}
+	}
+	return fs
+}
+
+// redactUrl removes the password from a URL.
+func redactUrl(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return p.Redacted()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	encjson "encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	upstream, _ := newTestServer(t)
+	news := &feedConfig{Name: "news", URL: upstream.URL + "/rss20.xml"}
+	sports := &feedConfig{Name: "sports", URL: upstream.URL + "/atom10.xml"}
+	for _, fc := range []*feedConfig{news, sports} {
+		if err := fc.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sched := newScheduler(newFetcher(0), nil, []*feedConfig{news, sports}, defaultHostLimit, 5*time.Second)
+	mux := routes(http.NotFoundHandler(), sched, nil, nil)
+
+	tests := []struct {
+		name   string
+		poll   string
+		status int
+	}{
+		{"before the first poll", "", http.StatusServiceUnavailable},
+		{"one feed polled", "news", http.StatusServiceUnavailable},
+		{"all feeds polled", "sports", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if tt.poll != "" {
+			if _, ok := sched.get(context.Background(), tt.poll); !ok {
+				t.Fatalf("%s: feed not found", tt.poll)
+			}
+		}
+		if rec := requestPath(t, mux, "/readyz", nil); rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+
+	// a feed that is added later doesn't make it unready again
+	late := &feedConfig{Name: "late", URL: upstream.URL + "/rdf.xml"}
+	if err := late.validate(); err != nil {
+		t.Fatal(err)
+	}
+	sched.set(late)
+	if rec := requestPath(t, mux, "/readyz", nil); rec.Code != http.StatusOK {
+		t.Errorf("feed added: status %d", rec.Code)
+	}
+
+	empty := newScheduler(newFetcher(0), nil, nil, defaultHostLimit, 5*time.Second)
+	if rec := requestPath(t, routes(http.NotFoundHandler(), empty, nil, nil), "/readyz", nil); rec.Code != http.StatusOK {
+		t.Errorf("no feeds: status %d", rec.Code)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	f := newFetcher(0)
+	sched := newScheduler(f, nil, nil, defaultHostLimit, 0)
+	h := newRssHandler("user", "secret", false, f, newStaleCache(0), sched, nil, 0, "")
+	mux := routes(h, sched, nil, nil)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/healthz", http.StatusOK},
+		{"/readyz", http.StatusOK},
+		{"/status", http.StatusUnauthorized},
+		{"/api/feeds", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := requestPath(t, mux, tt.path, nil); rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	upstream, h := newTestServer(t)
+	feeds := []*feedConfig{
+		{Name: "news", URL: upstream.URL + "/rss20.xml", Filter: `Title ~= "Bonn"`},
+		{Name: "missing", URL: upstream.URL + "/missing.xml"},
+		{Name: "private", URL: strings.Replace(upstream.URL, "http://", "http://user:secret@", 1) + "/atom10.xml"},
+		{Name: "idle", URL: upstream.URL + "/rdf.xml"},
+	}
+	for _, fc := range feeds {
+		if err := fc.validate(); err != nil {
+			t.Fatal(err)
+		}
+		h.scheduler.set(fc)
+	}
+	for _, name := range []string{"news", "missing", "private"} {
+		if _, ok := h.scheduler.get(context.Background(), name); !ok {
+			t.Fatalf("%s: feed not found", name)
+		}
+	}
+
+	rec := requestPath(t, h, "/status", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, content type %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var status struct {
+		Feeds []feedStatus `json:"feeds"`
+	}
+	if err := encjson.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]feedStatus{}
+	for _, fs := range status.Feeds {
+		got[fs.Name] = fs
+	}
+
+	tests := []struct {
+		name       string
+		polled     bool
+		success    bool
+		lastError  bool
+		lastStatus int
+		itemsIn    int
+		itemsKept  int
+	}{
+		{"news", true, true, false, http.StatusOK, 3, 2},
+		{"missing", true, false, true, http.StatusNotFound, 0, 0},
+		{"private", true, true, false, http.StatusOK, 3, 3},
+		{"idle", false, false, false, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		fs, ok := got[tt.name]
+		if !ok {
+			t.Errorf("%s: not in the status", tt.name)
+			continue
+		}
+		if (fs.LastFetch != nil) != tt.polled || (fs.NextPoll != nil) != tt.polled {
+			t.Errorf("%s: last fetch %v, next poll %v", tt.name, fs.LastFetch, fs.NextPoll)
+		}
+		if (fs.LastSuccess != nil) != tt.success || (fs.CacheAge != nil) != tt.success {
+			t.Errorf("%s: last success %v, cache age %v", tt.name, fs.LastSuccess, fs.CacheAge)
+		}
+		if (fs.LastError != "") != tt.lastError {
+			t.Errorf("%s: last error %q", tt.name, fs.LastError)
+		}
+		if fs.LastStatus != tt.lastStatus || fs.ItemsIn != tt.itemsIn || fs.ItemsKept != tt.itemsKept {
+			t.Errorf("%s: got status %d, %d items in, %d kept, want %d, %d, %d", tt.name, fs.LastStatus, fs.ItemsIn, fs.ItemsKept, tt.lastStatus, tt.itemsIn, tt.itemsKept)
+		}
+	}
+	if u := got["private"].URL; strings.Contains(u, "secret") {
+		t.Errorf("password in the status: %s", u)
+	}
+}
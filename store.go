@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	encjson "encoding/json"
+	"github.com/mmcdole/gofeed"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"time"
+)
+
+// storedItem is an item that passed the filter of a named feed. Seq
+// numbers the items of a feed in the order they were first seen, it
+// assigns them to the pages of the archive.
+type storedItem struct {
+	Item *gofeed.Item `json:"item"`
+	Seen time.Time    `json:"seen"`
+	Seq  uint64       `json:"seq,omitempty"`
+}
+
+// date returns the date the item is ordered by.
+func (si storedItem) date() time.Time {
+	if si.Item.PublishedParsed != nil {
+		return *si.Item.PublishedParsed
+	}
+	if si.Item.UpdatedParsed != nil {
+		return *si.Item.UpdatedParsed
+	}
+	return si.Seen
+}
+
+// withDate returns the item, an item without a date gets the time it was
+// first seen, which doesn't change on later polls.
+func (si storedItem) withDate() *gofeed.Item {
+	if si.Item.PublishedParsed == nil && si.Item.UpdatedParsed == nil {
+		seen := si.Seen
+		si.Item.PublishedParsed = &seen
+	}
+	return si.Item
+}
+
+var (
+	bucketItems    = []byte("items")
+	bucketNotified = []byte("notified")
+)
+
+// itemStore persists the kept items of named feeds, so the output can
+// include items that already dropped off the upstream feed. It also
+// remembers which items were already notified.
+type itemStore struct {
+	db *bolt.DB
+}
+
+func openStore(path string) (*itemStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &itemStore{db: db}, nil
+}
+
+func (s *itemStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// feedBucket returns the bucket of the named feed inside the parent
+// bucket, it returns nil if it doesn't exist and create is false.
+func feedBucket(tx *bolt.Tx, parent []byte, feed string, create bool) (*bolt.Bucket, error) {
+	if !create {
+		p := tx.Bucket(parent)
+		if p == nil {
+			return nil, nil
+		}
+		return p.Bucket([]byte(feed)), nil
+	}
+	p, err := tx.CreateBucketIfNotExists(parent)
+	if err != nil {
+		return nil, err
+	}
+	return p.CreateBucketIfNotExists([]byte(feed))
+}
+
+// itemKey returns the key an item is stored with, the GUID if there is
+// one, otherwise the link or a hash of the title.
+func itemKey(item *gofeed.Item) string {
+	if item.GUID != "" {
+		return item.GUID
+	}
+	if item.Link != "" {
+		return item.Link
+	}
+	h := sha1.Sum([]byte(item.Title + item.Description))
+	return hex.EncodeToString(h[:])
+}
+
+// save stores the items of the named feed. Items that are already known
+// are updated but keep the time they were first seen.
+func (s *itemStore) save(feed string, items []*gofeed.Item) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketItems, feed, true)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			key := []byte(itemKey(item))
+			si := storedItem{Item: item, Seen: now}
+			if v := b.Get(key); v != nil {
+				var old storedItem
+				if err := encjson.Unmarshal(v, &old); err == nil {
+					si.Seen = old.Seen
+					si.Seq = old.Seq
+				}
+			}
+			if si.Seq == 0 {
+				if si.Seq, err = b.NextSequence(); err != nil {
+					return err
+				}
+			}
+			data, err := encjson.Marshal(si)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// history returns the stored items of the named feed, newest first.
+// At most maxItems items are returned, that are not older than maxAge,
+// a value of 0 disables the limit. Items beyond the limits are removed,
+// unless they are on a complete page of the archive of pageSize items, so
+// the archive doesn't change. The archive keeps the last maxPages pages,
+// older pages and pages whose items are all older than maxAge are removed
+// as a whole. A pageSize of 0 means there is no archive.
+func (s *itemStore) history(feed string, maxItems int, maxAge time.Duration, pageSize, maxPages int) ([]*gofeed.Item, error) {
+	var all []storedItem
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketItems, feed, false)
+		if err != nil || b == nil {
+			return err
+		}
+		var stored []storedItem
+		var expired [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			var si storedItem
+			if err := encjson.Unmarshal(v, &si); err != nil || si.Item == nil {
+				expired = append(expired, k)
+				return nil
+			}
+			stored = append(stored, si)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := renumber(b, stored); err != nil {
+			return err
+		}
+		var archived, dropped uint64
+		if pageSize > 0 {
+			archived = b.Sequence() / uint64(pageSize) * uint64(pageSize)
+			dropped = expiredPages(stored, uint64(pageSize), archived, maxAge, maxPages)
+		}
+
+		sort.SliceStable(stored, func(i, j int) bool {
+			return stored[i].date().After(stored[j].date())
+		})
+		for _, si := range stored {
+			if si.Seq <= dropped {
+				expired = append(expired, []byte(itemKey(si.Item)))
+				continue
+			}
+			if maxAge > 0 && time.Since(si.date()) > maxAge || maxItems > 0 && len(all) >= maxItems {
+				if si.Seq > archived {
+					expired = append(expired, []byte(itemKey(si.Item)))
+				}
+				continue
+			}
+			all = append(all, si)
+		}
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*gofeed.Item, len(all))
+	for i, si := range all {
+		items[i] = si.withDate()
+	}
+	return items, nil
+}
+
+// expiredPages returns the highest sequence number of the items on the
+// expired pages of the archive, the complete pages up to archived. Pages
+// expire from the oldest on, if there are more than maxPages or if all
+// their items are older than maxAge, so the pages that are left are
+// still linked to each other.
+func expiredPages(items []storedItem, size, archived uint64, maxAge time.Duration, maxPages int) uint64 {
+	pages := archived / size
+	var dropped uint64
+	if maxPages > 0 && pages > uint64(maxPages) {
+		dropped = (pages - uint64(maxPages)) * size
+	}
+	if maxAge <= 0 {
+		return dropped
+	}
+	newest := map[uint64]time.Time{}
+	for _, si := range items {
+		if p := (si.Seq - 1) / size; si.Seq > 0 && si.Seq <= archived && si.date().After(newest[p]) {
+			newest[p] = si.date()
+		}
+	}
+	for p := dropped / size; p < pages; p++ {
+		if d, ok := newest[p]; ok && time.Since(d) <= maxAge {
+			break
+		}
+		dropped = (p + 1) * size
+	}
+	return dropped
+}
+
+// renumber gives the items of a feed new sequence numbers in the order
+// they were first seen, if some of them have none. Items that were stored
+// before the archive existed have none, this way they are archived too.
+func renumber(b *bolt.Bucket, items []storedItem) error {
+	missing := false
+	for _, si := range items {
+		missing = missing || si.Seq == 0
+	}
+	if !missing {
+		return nil
+	}
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		x, y := items[order[i]], items[order[j]]
+		if !x.Seen.Equal(y.Seen) {
+			return x.Seen.Before(y.Seen)
+		}
+		return x.Seq < y.Seq
+	})
+	for n, i := range order {
+		items[i].Seq = uint64(n + 1)
+		data, err := encjson.Marshal(items[i])
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(itemKey(items[i].Item)), data); err != nil {
+			return err
+		}
+	}
+	return b.SetSequence(uint64(len(items)))
+}
+
+// archive returns the stored items of the named feed with a sequence
+// number from first to last, newest first.
+func (s *itemStore) archive(feed string, first, last uint64) ([]*gofeed.Item, error) {
+	var list []storedItem
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketItems, feed, false)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var si storedItem
+			if err := encjson.Unmarshal(v, &si); err == nil && si.Item != nil && si.Seq >= first && si.Seq <= last {
+				list = append(list, si)
+			}
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Seq > list[j].Seq
+	})
+	items := make([]*gofeed.Item, len(list))
+	for i, si := range list {
+		items[i] = si.withDate()
+	}
+	return items, err
+}
+
+// firstSequence returns the lowest sequence number of the stored items
+// of the named feed, or 0 if there are none.
+func (s *itemStore) firstSequence(feed string) (uint64, error) {
+	var first uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketItems, feed, false)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var si storedItem
+			if err := encjson.Unmarshal(v, &si); err == nil && si.Seq > 0 && (first == 0 || si.Seq < first) {
+				first = si.Seq
+			}
+			return nil
+		})
+	})
+	return first, err
+}
+
+// sequence returns the highest sequence number of the named feed.
+func (s *itemStore) sequence(feed string) (uint64, error) {
+	var seq uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketItems, feed, false)
+		if err == nil && b != nil {
+			seq = b.Sequence()
+		}
+		return err
+	})
+	return seq, err
+}
+
+// notified returns the keys of the named feed that are in the notified
+// state.
+func (s *itemStore) notified(feed string) (map[string]bool, error) {
+	keys := map[string]bool{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketNotified, feed, false)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			keys[string(k)] = true
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// markNotified records the keys as notified and removes keys that were
+// recorded before maxAge.
+func (s *itemStore) markNotified(feed string, keys []string, maxAge time.Duration) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketNotified, feed, true)
+		if err != nil {
+			return err
+		}
+		ts, _ := now.MarshalText()
+		for _, k := range keys {
+			if err := b.Put([]byte(k), ts); err != nil {
+				return err
+			}
+		}
+
+		var expired [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			var t time.Time
+			if err := t.UnmarshalText(v); err != nil || now.Sub(t) > maxAge {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
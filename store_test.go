@@ -0,0 +1,236 @@
+package main
+
+import (
+	encjson "encoding/json"
+	"github.com/mmcdole/gofeed"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) *itemStore {
+	t.Helper()
+	store, err := openStore(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Now()
+	item := func(guid string, age time.Duration) *gofeed.Item {
+		pub := now.Add(-age)
+		return &gofeed.Item{GUID: guid, Title: guid, PublishedParsed: &pub}
+	}
+	items := []*gofeed.Item{
+		item("a", time.Hour),
+		item("b", 3*24*time.Hour),
+		item("c", 10*24*time.Hour),
+		item("d", 2*time.Hour),
+		{Title: "undated"},
+	}
+	tests := []struct {
+		name     string
+		maxItems int
+		maxAge   time.Duration
+		want     []string
+	}{
+		{"unlimited", 0, 0, []string{"undated", "a", "d", "b", "c"}},
+		{"count", 3, 0, []string{"undated", "a", "d"}},
+		{"age", 0, 7 * 24 * time.Hour, []string{"undated", "a", "d", "b"}},
+		{"count and age", 2, 7 * 24 * time.Hour, []string{"undated", "a"}},
+		{"more than stored", 10, 30 * 24 * time.Hour, []string{"undated", "a", "d", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t)
+			if err := store.save("news", items); err != nil {
+				t.Fatal(err)
+			}
+			list, err := store.history("news", tt.maxItems, tt.maxAge, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := itemTitles(list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			// pruned items are removed from the store
+			list, err = store.history("news", 0, 0, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := itemTitles(list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("after pruning: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveKeepsFirstSeen(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.save("news", []*gofeed.Item{{GUID: "a", Title: "old"}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := store.save("news", []*gofeed.Item{{GUID: "b", Title: "b"}, {GUID: "a", Title: "new"}}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.history("news", 0, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// undated items are ordered by the time they were first seen
+	if got := itemTitles(list); !reflect.DeepEqual(got, []string{"b", "new"}) {
+		t.Errorf("got %q", got)
+	}
+	// and get that time as their date
+	if list[1].PublishedParsed == nil || !list[1].PublishedParsed.Before(*list[0].PublishedParsed) {
+		t.Errorf("got dates %v and %v", list[0].PublishedParsed, list[1].PublishedParsed)
+	}
+	again, err := store.history("news", 0, 0, 0, 0)
+	if err != nil || !again[1].PublishedParsed.Equal(*list[1].PublishedParsed) {
+		t.Errorf("first seen date changed: %v, %v", again[1].PublishedParsed, err)
+	}
+	if seq, err := store.sequence("news"); err != nil || seq != 2 {
+		t.Errorf("sequence %d, %v", seq, err)
+	}
+	if list, err := store.history("other", 0, 0, 0, 0); err != nil || len(list) != 0 {
+		t.Errorf("unknown feed: %d items, %v", len(list), err)
+	}
+}
+
+func TestHistoryKeepsArchive(t *testing.T) {
+	now := time.Now()
+	for _, pageSize := range []int{0, 2} {
+		store := openTestStore(t)
+		for i, guid := range []string{"a", "b", "c", "d", "e"} {
+			pub := now.Add(time.Duration(i-10) * 24 * time.Hour)
+			if guid == "d" || guid == "e" {
+				pub = now.Add(time.Duration(i-6) * 24 * time.Hour)
+			}
+			if err := store.save("news", []*gofeed.Item{{GUID: guid, Title: guid, PublishedParsed: &pub}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		list, err := store.history("news", 1, 7*24*time.Hour, pageSize, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := itemTitles(list); !reflect.DeepEqual(got, []string{"e"}) {
+			t.Errorf("page size %d: got %q", pageSize, got)
+		}
+
+		// the expired item c is kept on the complete page 2, page 1 only
+		// has expired items and is removed
+		want := []string{"e"}
+		if pageSize > 0 {
+			want = []string{"e", "d", "c"}
+		}
+		archived, err := store.archive("news", 1, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := itemTitles(archived); !reflect.DeepEqual(got, want) {
+			t.Errorf("page size %d: stored %q, want %q", pageSize, got, want)
+		}
+	}
+}
+
+func TestHistoryExpiresArchive(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		maxPages int
+		want     []string
+		first    uint64
+	}{
+		{"no limits", 0, 0, []string{"g", "f", "e", "d", "c", "b", "a"}, 1},
+		{"max pages", 0, 2, []string{"g", "f", "e", "d", "c"}, 3},
+		{"max pages above pages", 0, 5, []string{"g", "f", "e", "d", "c", "b", "a"}, 1},
+		{"max age", 5 * 24 * time.Hour, 0, []string{"g", "f", "e", "d", "c"}, 3},
+		{"max age of two pages", 84 * time.Hour, 0, []string{"g", "f", "e"}, 5},
+		{"max age and pages", 9 * 24 * time.Hour, 1, []string{"g", "f", "e"}, 5},
+	}
+	for _, tt := range tests {
+		store := openTestStore(t)
+		// three complete pages of two items and the item g on the
+		// incomplete page 4, a is the oldest item
+		for i, guid := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			pub := now.Add(time.Duration(i-7) * 24 * time.Hour)
+			if err := store.save("news", []*gofeed.Item{{GUID: guid, Title: guid, PublishedParsed: &pub}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := store.history("news", 0, tt.maxAge, 2, tt.maxPages); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := store.archive("news", 1, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := itemTitles(stored); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		if first, err := store.firstSequence("news"); err != nil || first != tt.first {
+			t.Errorf("%s: first sequence %d, want %d", tt.name, first, tt.first)
+		}
+	}
+}
+
+func TestHistoryNumbersOldItems(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Now()
+	// items stored before the archive existed have no sequence number
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		b, err := feedBucket(tx, bucketItems, "news", true)
+		if err != nil {
+			return err
+		}
+		for i, guid := range []string{"b", "a"} {
+			data, err := encjson.Marshal(storedItem{Item: &gofeed.Item{GUID: guid, Title: guid}, Seen: now.Add(time.Duration(i-10) * time.Hour)})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(guid), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.save("news", []*gofeed.Item{{GUID: "c", Title: "c"}, {GUID: "b", Title: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.history("news", 0, 0, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	archived, err := store.archive("news", 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := itemTitles(archived); !reflect.DeepEqual(got, []string{"c", "a", "b"}) {
+		t.Errorf("got %q", got)
+	}
+	if seq, err := store.sequence("news"); err != nil || seq != 3 {
+		t.Errorf("sequence %d, %v", seq, err)
+	}
+	if first, err := store.firstSequence("news"); err != nil || first != 1 {
+		t.Errorf("first sequence %d, %v", first, err)
+	}
+}
+
+func itemTitles(items []*gofeed.Item) []string {
+	list := []string{}
+	for _, item := range items {
+		list = append(list, item.Title)
+	}
+	return list
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+)
+
+// normalizers are the filter functions that normalize text. They are
+// applied to the value of a condition too, so fold(Title) == "STRASSE"
+// matches "Straße".
+var normalizers = map[string]func(string) string{
+	"nfc":      norm.NFC.String,
+	"nfkc":     norm.NFKC.String,
+	"fold":     foldCase,
+	"unaccent": unaccent,
+	"stem_en":  func(s string) string { return stemWords(s, stemEnglish) },
+	"stem_de":  func(s string) string { return stemWords(s, stemGerman) },
+}
+
+// valueNormalizer returns a function that normalizes the value of a
+// condition like the normalizers the key is wrapped in, e.g. fold for
+// fold(unaccent(Title)). Values are always normalized to NFC, like the
+// text of the items.
+func valueNormalizer(key string) func(string) string {
+	var chain []func(string) string
+	for m := funcCall.FindStringSubmatch(key); m != nil; m = funcCall.FindStringSubmatch(m[2]) {
+		f, ok := normalizers[strings.ToLower(m[1])]
+		if !ok {
+			break
+		}
+		chain = append(chain, f)
+	}
+	return func(s string) string {
+		s = norm.NFC.String(s)
+		for i := len(chain) - 1; i >= 0; i-- {
+			s = chain[i](s)
+		}
+		return s
+	}
+}
+
+// foldCase returns the NFKC normalized and case folded text, e.g. "strasse"
+// for "Straße" and "file" for "ﬁle".
+func foldCase(s string) string {
+	return cases.Fold().String(norm.NFKC.String(s))
+}
+
+// unaccent removes the diacritics of the text, e.g. "Koln" for "Köln".
+func unaccent(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	r, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return r
+}
+
+// textWords splits the text into words, which are made of letters, digits
+// and combining marks.
+func textWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r)
+	})
+}
+
+// hasWord reports whether the text contains the words of phrase in a row,
+// compared case folded. "Bonn" is a word of "Bonn's bridge" but not of
+// "Bonner Str".
+func hasWord(s, phrase string) bool {
+	words, want := textWords(foldCase(s)), textWords(foldCase(phrase))
+	if len(want) == 0 {
+		return false
+	}
+	for i := 0; i+len(want) <= len(words); i++ {
+		match := true
+		for j, w := range want {
+			if words[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// stemWords returns the case folded stems of the words of the text,
+// separated by a space.
+func stemWords(s string, stem func(string) string) string {
+	words := textWords(foldCase(s))
+	for i, w := range words {
+		words[i] = stem(w)
+	}
+	return strings.Join(words, " ")
+}
+
+// stemEnglish is a light stemmer for folded English words, it removes the
+// common inflections and a final e, e.g. "run" for "running" and "clos"
+// for both "close" and "closed".
+func stemEnglish(w string) string {
+	r := []rune(w)
+	switch {
+	case len(r) > 4 && hasSuffix(r, "ies"):
+		r = append(r[:len(r)-3], 'y')
+	case len(r) > 4 && (hasSuffix(r, "sses") || hasSuffix(r, "xes") || hasSuffix(r, "ches") || hasSuffix(r, "shes")):
+		r = r[:len(r)-2]
+	case len(r) > 3 && hasSuffix(r, "s") && !hasSuffix(r, "ss") && !hasSuffix(r, "us") && !hasSuffix(r, "is"):
+		r = r[:len(r)-1]
+	}
+	switch {
+	case len(r) > 5 && hasSuffix(r, "ing"):
+		r = undouble(r[:len(r)-3])
+	case len(r) > 4 && hasSuffix(r, "ed"):
+		r = undouble(r[:len(r)-2])
+	case len(r) > 4 && hasSuffix(r, "ly"):
+		r = r[:len(r)-2]
+	}
+	if len(r) > 3 && hasSuffix(r, "e") {
+		r = r[:len(r)-1]
+	}
+	return string(r)
+}
+
+// undouble removes the last of a double consonant, e.g. "run" for "runn",
+// but keeps ll, ss and zz.
+func undouble(r []rune) []rune {
+	n := len(r)
+	if n > 2 && r[n-1] == r[n-2] && !strings.ContainsRune("aeioulsz", r[n-1]) {
+		return r[:n-1]
+	}
+	return r
+}
+
+// stemGerman is a light stemmer for folded German words after CISTEM, it
+// replaces umlauts and removes the common suffixes but not a double letter,
+// e.g. "bruck" for "Brücken" and "bonn" for "Bonner".
+func stemGerman(w string) string {
+	w = strings.NewReplacer("ä", "a", "ö", "o", "ü", "u").Replace(w)
+	r := []rune(w)
+	for len(r) > 3 {
+		if len(r) > 5 && (hasSuffix(r, "em") || hasSuffix(r, "er") || hasSuffix(r, "nd")) {
+			r = r[:len(r)-2]
+		} else if strings.ContainsRune("enst", r[len(r)-1]) && r[len(r)-1] != r[len(r)-2] {
+			r = r[:len(r)-1]
+		} else {
+			break
+		}
+	}
+	return string(r)
+}
+
+func hasSuffix(r []rune, suffix string) bool {
+	return strings.HasSuffix(string(r), suffix)
+}
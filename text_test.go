@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+	"testing"
+	"time"
+)
+
+func TestHasWord(t *testing.T) {
+	tests := []struct {
+		s, phrase string
+		want      bool
+	}{
+		{"Bonn opens new bridge", "Bonn", true},
+		{"Bonner Str. closed", "Bonn", false},
+		{"Bonn's bridge", "bonn", true},
+		{"Die Straße in Köln", "STRASSE", true},
+		{"Die Straße in Köln", "in köln", true},
+		{"Die Straße in Köln", "Köln Straße", false},
+		{"Die Straße in Köln", "Köln", true},
+		{"Die Straße in Köln", "Koln", false},
+		{"Bonn", "", false},
+	}
+	for _, tt := range tests {
+		if got := hasWord(tt.s, tt.phrase); got != tt.want {
+			t.Errorf("%q has word %q: got %t, want %t", tt.s, tt.phrase, got, tt.want)
+		}
+	}
+}
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		stem  func(string) string
+		words []string
+	}{
+		{stemEnglish, []string{"bridge", "bridges"}},
+		{stemEnglish, []string{"close", "closed", "closes"}},
+		{stemEnglish, []string{"run", "running"}},
+		{stemEnglish, []string{"city", "cities"}},
+		{stemEnglish, []string{"church", "churches"}},
+		{stemGerman, []string{"brücke", "brücken"}},
+		{stemGerman, []string{"bonn", "bonner"}},
+		{stemGerman, []string{"spiel", "spiele", "spielen", "spielt", "spielend"}},
+		{stemGerman, []string{"haus", "häuser"}},
+	}
+	for _, tt := range tests {
+		want := tt.stem(tt.words[0])
+		for _, w := range tt.words[1:] {
+			if got := tt.stem(w); got != want {
+				t.Errorf("stem of %s is %s, stem of %s is %s", w, got, tt.words[0], want)
+			}
+		}
+	}
+}
+
+func TestNormalizedFilters(t *testing.T) {
+	item := &gofeed.Item{
+		// decomposed ö and a ligature
+		Title:       "Ko\u0308lner Straße: Brücken gesperrt, \ufb01les closed",
+		Description: "Running late",
+	}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`Title contains "Kölner"`, true},
+		{`Title ~= "Kölner"`, true},
+		{`Title has word "kölner straße"`, true},
+		{`Title has word "köln"`, false},
+		{`Title has word "files"`, true},
+		{`fold(Title) contains "STRASSE"`, true},
+		{`fold(Title) ~= "STRASSE"`, false},
+		{`unaccent(Title) startswith "Kolner"`, true},
+		{`unaccent(Title) startswith "Kölner"`, true},
+		{`fold(unaccent(Title)) contains "KOLNER STRASSE"`, true},
+		{`nfkc(Title) contains "files"`, true},
+		{`Title contains "files"`, false},
+		{`stem_de(Title) has word "Brücke"`, true},
+		{`stem_de(Title) has word "gesperrte"`, true},
+		{`stem_en(Description) has word "run"`, true},
+		{`stem_en(Title) in ("a", "b")`, false},
+		{`len(fold(Title)) > 10`, true},
+	}
+	for _, tt := range tests {
+		c, err := parseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+		got, err := checkItem(c, nil, item, time.Now())
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %t, %v, want %t", tt.filter, got, err, tt.want)
+		}
+	}
+
+	for _, filter := range []string{`Title has "Bonn"`, `Title has word ""`, `Title has word "-"`, `stem_fr(Title) == "a"`} {
+		if _, err := parseFilter(filter); err == nil {
+			t.Errorf("%s: expected an error", filter)
+		}
+	}
+}
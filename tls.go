@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	certCheckInterval = 10 * time.Second
+	defaultAcmeCache  = "acme-cache"
+)
+
+// certReloader serves a certificate from files and reloads it when the
+// files change, so renewed certificates are used without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) > certCheckInterval {
+		if err := c.reload(); err != nil {
+			log.Err(err).Str("cert", c.certFile).Msg("can't reload certificate, keeping the old one")
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the certificate if one of the files changed since the
+// last load, c.mu must be held unless c is not shared yet.
+func (c *certReloader) reload() error {
+	c.checked = time.Now()
+	var modTime time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		log.Info().Str("cert", c.certFile).Msg("certificate reloaded")
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// newAcmeManager returns a manager that obtains certificates for the
+// domains from the ACME server at dirUrl, Let's Encrypt if it is empty.
+// caFile is an optional PEM file with CA certificates that are trusted
+// for the connection to the ACME server, e.g. of a test server.
+func newAcmeManager(domains []string, email, dirUrl, cacheDir, caFile string) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: dirUrl, UserAgent: userAgent()}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	if cacheDir == "" {
+		cacheDir = defaultAcmeCache
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+		Client:     client,
+	}, nil
+}
+
+// redirectHTTPS redirects all requests to the same URL with https, the
+// port of the https server is kept unless it is the default one.
+func redirectHTTPS(tlsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// splitList splits a comma separated list and drops empty entries.
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
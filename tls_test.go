@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for name and its key to
+// the files and sets their modification time.
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modTime)
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), modTime)
+}
+
+func writeTestFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// certName returns the common name of the certificate c serves.
+func certName(t *testing.T, c *certReloader) string {
+	t.Helper()
+	c.mu.Lock()
+	c.checked = time.Time{}
+	c.mu.Unlock()
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("missing files: expected an error")
+	}
+	start := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "a.example.org", start)
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		want   string
+	}{
+		{"unchanged", func() {}, "a.example.org"},
+		{"renewed", func() {
+			writeTestCert(t, certFile, keyFile, "b.example.org", start.Add(time.Minute))
+		}, "b.example.org"},
+		{"same modification time", func() {
+			writeTestCert(t, certFile, keyFile, "c.example.org", start.Add(time.Minute))
+		}, "b.example.org"},
+		{"invalid certificate", func() {
+			writeTestFile(t, certFile, []byte("not a certificate"), start.Add(2*time.Minute))
+		}, "b.example.org"},
+		{"missing key", func() {
+			if err := os.Remove(keyFile); err != nil {
+				t.Fatal(err)
+			}
+		}, "b.example.org"},
+		{"renewed again", func() {
+			writeTestCert(t, certFile, keyFile, "d.example.org", start.Add(3*time.Minute))
+		}, "d.example.org"},
+	}
+	for _, tt := range tests {
+		tt.change()
+		if got := certName(t, c); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// the files are only checked every certCheckInterval
+	old, _ := c.GetCertificate(&tls.ClientHelloInfo{})
+	writeTestCert(t, certFile, keyFile, "e.example.org", start.Add(4*time.Minute))
+	if cert, _ := c.GetCertificate(&tls.ClientHelloInfo{}); cert != old {
+		t.Error("certificate reloaded before the check interval")
+	}
+	if got := certName(t, c); got != "e.example.org" {
+		t.Errorf("after the check interval: got %s", got)
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+		uri     string
+		want    string
+	}{
+		{":443", "example.org", "/", "https://example.org/"},
+		{":443", "example.org:80", "/feeds/news?out=atom&limit=2", "https://example.org/feeds/news?out=atom&limit=2"},
+		{":8443", "example.org:8080", "/?feed_url=https%3A%2F%2Fexample.org%2Ffeed.xml", "https://example.org:8443/?feed_url=https%3A%2F%2Fexample.org%2Ffeed.xml"},
+		{"0.0.0.0:8443", "example.org", "/status", "https://example.org:8443/status"},
+		{"", "example.org:80", "/", "https://example.org/"},
+		{":443", "[::1]:80", "/healthz", "https://[::1]/healthz"},
+		{":443", "[2001:db8::1]", "/", "https://[2001:db8::1]/"},
+		{":8443", "[2001:db8::1]:8080", "/?a=b", "https://[2001:db8::1]:8443/?a=b"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.uri, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		redirectHTTPS(tt.address).ServeHTTP(rec, req)
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != tt.want {
+			t.Errorf("%s %s%s: got %d %s, want %s", tt.address, tt.host, tt.uri, rec.Code, rec.Header().Get("Location"), tt.want)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	encjson "encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envOtelDisabled       = "OTEL_SDK_DISABLED"
+	envOtelExporter       = "OTEL_TRACES_EXPORTER"
+	envOtelEndpoint       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	envOtelTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	envOtelHeaders        = "OTEL_EXPORTER_OTLP_HEADERS"
+	envOtelTracesHeaders  = "OTEL_EXPORTER_OTLP_TRACES_HEADERS"
+	envOtelProtocol       = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	envOtelServiceName    = "OTEL_SERVICE_NAME"
+	envOtelResource       = "OTEL_RESOURCE_ATTRIBUTES"
+	envOtelSampler        = "OTEL_TRACES_SAMPLER"
+	envOtelSamplerArg     = "OTEL_TRACES_SAMPLER_ARG"
+
+	headerTraceparent = "traceparent"
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	exportBatchSize = 512
+	exportQueueSize = 2048
+	exportInterval  = 5 * time.Second
+	exportTimeout   = 10 * time.Second
+)
+
+// tracer exports the spans, tracing is disabled if it is nil.
+var tracer *exporter
+
+// spanContext identifies a span, it is propagated with the W3C
+// traceparent header.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// span is a timed stage of a request or poll. All methods can be called
+// on a nil span, that is what startSpan returns if tracing is disabled.
+type span struct {
+	spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+
+	mu     sync.Mutex
+	attrs  []otlpAttr
+	events []otlpEvent
+	err    error
+}
+
+// startSpan starts a span as child of the span in ctx, or of the remote
+// parent in ctx. The returned context carries the new span.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	sp := &span{name: name, kind: kind, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey).(spanContext); ok {
+		sp.traceID = parent.traceID
+		sp.parent = parent.spanID
+		sp.sampled = parent.sampled
+		if !tracer.parentBased {
+			sp.sampled = tracer.sample(sp.traceID)
+		}
+	} else if parent, ok := ctx.Value(spanKey).(*span); ok {
+		sp.traceID = parent.traceID
+		sp.parent = parent.spanID
+		sp.sampled = parent.sampled
+	} else {
+		_, _ = rand.Read(sp.traceID[:])
+		sp.sampled = tracer.sample(sp.traceID)
+	}
+	_, _ = rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey, sp), sp
+}
+
+// withRemoteParent returns a context with the span context of the
+// traceparent header as parent for new spans.
+func withRemoteParent(ctx context.Context, header http.Header) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+	if sc, ok := parseTraceparent(header.Get(headerTraceparent)); ok {
+		return context.WithValue(ctx, spanKey, sc)
+	}
+	return ctx
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(v string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// traceparent returns the W3C traceparent header value of the span.
+func (sp *span) traceparent() string {
+	flags := "00"
+	if sp.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", sp.traceID, sp.spanID, flags)
+}
+
+// inject adds the traceparent header of the span to an outgoing request.
+func (sp *span) inject(header http.Header) {
+	if sp == nil {
+		return
+	}
+	header.Set(headerTraceparent, sp.traceparent())
+}
+
+// traceIDString returns the hex encoded trace ID, or an empty string.
+func (sp *span) traceIDString() string {
+	if sp == nil {
+		return ""
+	}
+	return hex.EncodeToString(sp.traceID[:])
+}
+
+// rename changes the name of the span.
+func (sp *span) rename(name string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.name = name
+}
+
+// set adds an attribute, the value must be a string, bool, int or float64.
+func (sp *span) set(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.attrs = append(sp.attrs, newAttr(key, value))
+}
+
+// event records a point in time during the span.
+func (sp *span) event(name string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.events = append(sp.events, otlpEvent{TimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10), Name: name})
+}
+
+// fail marks the span as failed.
+func (sp *span) fail(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.err = err
+}
+
+// finish ends the span and queues it for export.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.end = time.Now()
+	sp.mu.Unlock()
+	if sp.sampled {
+		tracer.queue(sp)
+	}
+}
+
+// exporter sends finished spans in batches to an OTLP/HTTP endpoint,
+// encoded as JSON.
+type exporter struct {
+	endpoint    string
+	header      http.Header
+	resource    []otlpAttr
+	ratio       float64
+	parentBased bool
+	client      *http.Client
+	spans       chan *span
+	flush       chan chan struct{}
+}
+
+// setupTracing configures the exporter from the standard OTEL_*
+// environment variables. Tracing stays disabled without an endpoint.
+func setupTracing() error {
+	if disabled, _ := strconv.ParseBool(os.Getenv(envOtelDisabled)); disabled {
+		return nil
+	}
+	if e := os.Getenv(envOtelExporter); e != "" && e != "otlp" {
+		return nil
+	}
+	if p := os.Getenv(envOtelProtocol); p != "" && p != "http/json" {
+		return fmt.Errorf("unsupported %s: %s, only http/json is supported", envOtelProtocol, p)
+	}
+
+	endpoint := os.Getenv(envOtelTracesEndpoint)
+	if endpoint == "" {
+		base := os.Getenv(envOtelEndpoint)
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return fmt.Errorf("invalid otlp endpoint: %w", err)
+	}
+
+	e := &exporter{
+		endpoint: endpoint,
+		header:   http.Header{},
+		ratio:    1,
+		client:   &http.Client{Timeout: exportTimeout},
+		spans:    make(chan *span, exportQueueSize),
+		flush:    make(chan chan struct{}),
+	}
+	for _, env := range []string{envOtelHeaders, envOtelTracesHeaders} {
+		for k, v := range parseKeyValues(os.Getenv(env)) {
+			e.header.Set(k, v)
+		}
+	}
+
+	resource := parseKeyValues(os.Getenv(envOtelResource))
+	if name := os.Getenv(envOtelServiceName); name != "" {
+		resource["service.name"] = name
+	} else if resource["service.name"] == "" {
+		resource["service.name"] = "rss-filter"
+	}
+	resource["service.version"] = version
+	for k, v := range resource {
+		e.resource = append(e.resource, newAttr(k, v))
+	}
+
+	sampler := os.Getenv(envOtelSampler)
+	e.parentBased = sampler == "" || strings.HasPrefix(sampler, "parentbased_")
+	switch sampler {
+	case "", "always_on", "parentbased_always_on":
+	case "always_off", "parentbased_always_off":
+		e.ratio = 0
+	case "traceidratio", "parentbased_traceidratio":
+		if arg := os.Getenv(envOtelSamplerArg); arg != "" {
+			r, err := strconv.ParseFloat(arg, 64)
+			if err != nil || r < 0 || r > 1 {
+				return fmt.Errorf("invalid %s: %s", envOtelSamplerArg, arg)
+			}
+			e.ratio = r
+		}
+	default:
+		return fmt.Errorf("unsupported %s: %s", envOtelSampler, sampler)
+	}
+
+	go e.run()
+	tracer = e
+	log.Info().Str("endpoint", redactUrl(endpoint)).Msg("exporting traces")
+	return nil
+}
+
+// sample decides if a new trace is recorded, based on the trace ID so
+// the decision is the same for every span of the trace.
+func (e *exporter) sample(traceID [16]byte) bool {
+	if e.ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>1) < e.ratio*float64(uint64(1)<<63)
+}
+
+func (e *exporter) queue(sp *span) {
+	select {
+	case e.spans <- sp:
+	default:
+		log.Warn().Str("span", sp.name).Msg("trace queue is full, dropping span")
+	}
+}
+
+func (e *exporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case sp := <-e.spans:
+			batch = append(batch, sp)
+			if len(batch) < exportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-e.flush:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			e.export(batch)
+			batch = nil
+			close(done)
+			continue
+		}
+		e.export(batch)
+		batch = nil
+	}
+}
+
+// shutdown exports the queued spans, it can be called on a nil exporter.
+func (e *exporter) shutdown(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *exporter) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		spans = append(spans, sp.otlp())
+	}
+	data, err := encjson.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: e.resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "rss-filter", Version: version}, Spans: spans}},
+	}}})
+	if err != nil {
+		log.Err(err).Msg("can't encode spans")
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		log.Err(err).Msg("can't export spans")
+		return
+	}
+	for k, v := range e.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Err(err).Int("spans", len(batch)).Msg("can't export spans")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Error().Str("status", resp.Status).Str("body", strings.TrimSpace(string(body))).Int("spans", len(batch)).Msg("can't export spans")
+	}
+}
+
+// parseKeyValues parses the key1=value1,key2=value2 format of the OTEL_*
+// environment variables, keys and values are URL encoded.
+func parseKeyValues(v string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range strings.Split(v, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		k, _ = url.PathUnescape(strings.TrimSpace(k))
+		v, _ = url.PathUnescape(strings.TrimSpace(v))
+		if k != "" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// The OTLP/JSON encoding of spans, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Events            []otlpEvent `json:"events,omitempty"`
+	Status            otlpStatus  `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func newAttr(key string, value interface{}) otlpAttr {
+	a := otlpAttr{Key: key}
+	switch v := value.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (sp *span) otlp() otlpSpan {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(sp.traceID[:]),
+		SpanID:            hex.EncodeToString(sp.spanID[:]),
+		Name:              sp.name,
+		Kind:              sp.kind,
+		StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+		Attributes:        sp.attrs,
+		Events:            sp.events,
+	}
+	if sp.parent != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(sp.parent[:])
+	}
+	if sp.err != nil {
+		s.Status = otlpStatus{Code: 2, Message: sp.err.Error()}
+	}
+	return s
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	encjson "encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectorRequest is an export request an OTLP collector received.
+type collectorRequest struct {
+	header http.Header
+	body   otlpRequest
+}
+
+func newTestCollector(t *testing.T) (*httptest.Server, func() []collectorRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []collectorRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body otlpRequest
+		if r.URL.Path != "/v1/traces" || encjson.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, collectorRequest{r.Header, body})
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []collectorRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]collectorRequest(nil), requests...)
+	}
+}
+
+// setupTestTracing sets up the exporter with the environment variables
+// and disables tracing again when the test is done.
+func setupTestTracing(t *testing.T, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	if err := setupTracing(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tracer = nil })
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03 ", true, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		sc, ok := parseTraceparent(tt.value)
+		if ok != tt.ok || sc.sampled != tt.sampled {
+			t.Errorf("%q: got %t, sampled %t, want %t, sampled %t", tt.value, ok, sc.sampled, tt.ok, tt.sampled)
+			continue
+		}
+		if ok && hex.EncodeToString(sc.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%q: got trace ID %x", tt.value, sc.traceID)
+		}
+	}
+
+	sp := &span{spanContext: spanContext{sampled: true}}
+	copy(sp.traceID[:], "0123456789abcdef")
+	copy(sp.spanID[:], "01234567")
+	sc, ok := parseTraceparent(sp.traceparent())
+	if !ok || sc != sp.spanContext {
+		t.Errorf("%s: doesn't round trip", sp.traceparent())
+	}
+}
+
+func TestSetupTracing(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		enabled     bool
+		endpoint    string
+		ratio       float64
+		parentBased bool
+		err         bool
+	}{
+		{"no endpoint", nil, false, "", 0, false, false},
+		{"endpoint", map[string]string{envOtelEndpoint: "http://otel:4318/"}, true, "http://otel:4318/v1/traces", 1, true, false},
+		{"traces endpoint", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelTracesEndpoint: "http://traces/in"}, true, "http://traces/in", 1, true, false},
+		{"disabled", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelDisabled: "true"}, false, "", 0, false, false},
+		{"other exporter", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelExporter: "zipkin"}, false, "", 0, false, false},
+		{"protobuf", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelProtocol: "http/protobuf"}, false, "", 0, false, true},
+		{"invalid endpoint", map[string]string{envOtelEndpoint: "otel"}, false, "", 0, false, true},
+		{"always off", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelSampler: "always_off"}, true, "http://otel:4318/v1/traces", 0, false, false},
+		{"ratio", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelSampler: "traceidratio", envOtelSamplerArg: "0.25"}, true, "http://otel:4318/v1/traces", 0.25, false, false},
+		{"parent based ratio", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelSampler: "parentbased_traceidratio", envOtelSamplerArg: "0.5"}, true, "http://otel:4318/v1/traces", 0.5, true, false},
+		{"invalid ratio", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelSampler: "traceidratio", envOtelSamplerArg: "2"}, false, "", 0, false, true},
+		{"unknown sampler", map[string]string{envOtelEndpoint: "http://otel:4318", envOtelSampler: "jaeger_remote"}, false, "", 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{envOtelDisabled, envOtelExporter, envOtelEndpoint, envOtelTracesEndpoint, envOtelProtocol, envOtelSampler, envOtelSamplerArg} {
+				t.Setenv(k, tt.env[k])
+			}
+			t.Cleanup(func() { tracer = nil })
+			err := setupTracing()
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if (tracer != nil) != tt.enabled {
+				t.Fatalf("got enabled %t, want %t", tracer != nil, tt.enabled)
+			}
+			if tracer == nil {
+				return
+			}
+			if tracer.endpoint != tt.endpoint || tracer.ratio != tt.ratio || tracer.parentBased != tt.parentBased {
+				t.Errorf("got %s, ratio %g, parent based %t", tracer.endpoint, tracer.ratio, tracer.parentBased)
+			}
+		})
+	}
+}
+
+func TestSampler(t *testing.T) {
+	low := [16]byte{}
+	high := [16]byte{8: 0xff, 9: 0xff, 10: 0xff, 11: 0xff, 12: 0xff, 13: 0xff, 14: 0xff, 15: 0xff}
+	mid := [16]byte{8: 0x60}
+	tests := []struct {
+		ratio          float64
+		low, mid, high bool
+	}{
+		{0, false, false, false},
+		{0.5, true, true, false},
+		{0.25, true, false, false},
+		{1, true, true, true},
+	}
+	for _, tt := range tests {
+		e := &exporter{ratio: tt.ratio}
+		if got := e.sample(low); got != tt.low {
+			t.Errorf("%g: low trace ID: got %t", tt.ratio, got)
+		}
+		if got := e.sample(mid); got != tt.mid {
+			t.Errorf("%g: mid trace ID: got %t", tt.ratio, got)
+		}
+		if got := e.sample(high); got != tt.high {
+			t.Errorf("%g: high trace ID: got %t", tt.ratio, got)
+		}
+	}
+
+	tracer = &exporter{ratio: 0.3}
+	defer func() { tracer = nil }()
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if _, sp := startSpan(context.Background(), "root", spanKindInternal); sp.sampled {
+			sampled++
+		}
+	}
+	if sampled < 2700 || sampled > 3300 {
+		t.Errorf("ratio 0.3: sampled %d of 10000 traces", sampled)
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	ctx, sp := startSpan(context.Background(), "disabled", spanKindInternal)
+	if sp != nil || ctx.Value(spanKey) != nil {
+		t.Fatal("got a span with tracing disabled")
+	}
+	// the methods of a nil span are no-ops
+	sp.set("key", "value")
+	sp.event("event")
+	sp.fail(errors.New("failed"))
+	sp.rename("renamed")
+	sp.inject(http.Header{})
+	sp.finish()
+	if sp.traceIDString() != "" {
+		t.Error("nil span has a trace ID")
+	}
+
+	tracer = &exporter{ratio: 0, parentBased: true, spans: make(chan *span, 10)}
+	defer func() { tracer = nil }()
+
+	ctx, root := startSpan(context.Background(), "root", spanKindServer)
+	if root.sampled || root.parent != [8]byte{} || root.traceID == [16]byte{} || root.spanID == [8]byte{} {
+		t.Errorf("root: got %+v", root.spanContext)
+	}
+	_, child := startSpan(ctx, "child", spanKindInternal)
+	if child.traceID != root.traceID || child.parent != root.spanID || child.spanID == root.spanID {
+		t.Errorf("child: got trace %x, parent %x", child.traceID, child.parent)
+	}
+
+	header := http.Header{}
+	header.Set(headerTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, remote := startSpan(withRemoteParent(context.Background(), header), "remote", spanKindServer)
+	if !remote.sampled || remote.traceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(remote.parent[:]) != "00f067aa0ba902b7" {
+		t.Errorf("parent based: got %+v", remote)
+	}
+	out := http.Header{}
+	remote.inject(out)
+	if sc, ok := parseTraceparent(out.Get(headerTraceparent)); !ok || sc != remote.spanContext {
+		t.Errorf("inject: got %s", out.Get(headerTraceparent))
+	}
+
+	tracer.parentBased = false
+	_, remote = startSpan(withRemoteParent(context.Background(), header), "remote", spanKindServer)
+	if remote.sampled {
+		t.Error("not parent based: the remote sampling decision is used")
+	}
+
+	root.finish()
+	child.finish()
+	if len(tracer.spans) != 0 {
+		t.Errorf("%d spans that aren't sampled are queued", len(tracer.spans))
+	}
+}
+
+func TestExport(t *testing.T) {
+	collector, requests := newTestCollector(t)
+	setupTestTracing(t, map[string]string{
+		envOtelEndpoint:      collector.URL,
+		envOtelHeaders:       "x-api-key=secret,x-tenant=a%20b",
+		envOtelTracesHeaders: "x-tenant=traces",
+		envOtelServiceName:   "",
+		envOtelResource:      "deployment.environment=test",
+	})
+
+	ctx, root := startSpan(context.Background(), "GET /", spanKindServer)
+	root.set("http.status_code", 200)
+	root.set("http.method", "GET")
+	root.set("cached", true)
+	root.set("ratio", 0.5)
+	_, child := startSpan(ctx, "fetch", spanKindClient)
+	child.event("retry")
+	child.fail(errors.New("upstream failed"))
+	child.finish()
+	root.rename("GET /feed")
+	root.finish()
+
+	if err := tracer.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("got %d export requests", len(got))
+	}
+	r := got[0]
+	if r.header.Get("Content-Type") != "application/json" || r.header.Get("X-Api-Key") != "secret" || r.header.Get("X-Tenant") != "traces" {
+		t.Errorf("got header %v", r.header)
+	}
+	if len(r.body.ResourceSpans) != 1 || len(r.body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %+v", r.body)
+	}
+	rs := r.body.ResourceSpans[0]
+	resource := map[string]string{}
+	for _, a := range rs.Resource.Attributes {
+		resource[a.Key] = *a.Value.StringValue
+	}
+	if resource["service.name"] != "rss-filter" || resource["service.version"] != version || resource["deployment.environment"] != "test" {
+		t.Errorf("got resource %v", resource)
+	}
+	ss := rs.ScopeSpans[0]
+	if ss.Scope.Name != "rss-filter" || len(ss.Spans) != 2 {
+		t.Fatalf("got %+v", ss)
+	}
+
+	c, p := ss.Spans[0], ss.Spans[1]
+	if p.Name != "GET /feed" || p.Kind != spanKindServer || p.ParentSpanID != "" || p.Status.Code != 0 || p.TraceID != root.traceIDString() {
+		t.Errorf("root: got %+v", p)
+	}
+	if p.StartTimeUnixNano == "" || p.EndTimeUnixNano < p.StartTimeUnixNano {
+		t.Errorf("root: got start %s, end %s", p.StartTimeUnixNano, p.EndTimeUnixNano)
+	}
+	if len(p.Attributes) != 4 || *p.Attributes[0].Value.IntValue != "200" || *p.Attributes[1].Value.StringValue != "GET" ||
+		!*p.Attributes[2].Value.BoolValue || *p.Attributes[3].Value.DoubleValue != 0.5 {
+		t.Errorf("root: got attributes %+v", p.Attributes)
+	}
+	if c.Name != "fetch" || c.Kind != spanKindClient || c.ParentSpanID != p.SpanID || c.TraceID != p.TraceID ||
+		c.Status.Code != 2 || c.Status.Message != "upstream failed" || len(c.Events) != 1 || c.Events[0].Name != "retry" {
+		t.Errorf("child: got %+v", c)
+	}
+}
+
+func TestExportBatches(t *testing.T) {
+	collector, requests := newTestCollector(t)
+	setupTestTracing(t, map[string]string{envOtelEndpoint: collector.URL})
+
+	for i := 0; i < exportBatchSize+3; i++ {
+		_, sp := startSpan(context.Background(), "span", spanKindInternal)
+		sp.finish()
+	}
+	// a full batch is exported right away, before the export interval
+	deadline := time.Now().Add(exportInterval / 2)
+	for len(requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := requests()
+	if len(got) != 1 || len(got[0].body.ResourceSpans[0].ScopeSpans[0].Spans) != exportBatchSize {
+		t.Fatalf("got %d export requests", len(got))
+	}
+
+	// shutdown exports the rest
+	if err := tracer.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got = requests()
+	if len(got) != 2 || len(got[1].body.ResourceSpans[0].ScopeSpans[0].Spans) != 3 {
+		t.Fatalf("after shutdown: got %d export requests", len(got))
+	}
+
+	// nothing to export
+	if err := tracer.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests()) != 2 {
+		t.Error("empty batch exported")
+	}
+
+	var e *exporter
+	if err := e.shutdown(context.Background()); err != nil {
+		t.Errorf("nil exporter: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (&exporter{flush: make(chan chan struct{})}).shutdown(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled shutdown: got %v", err)
+	}
+}
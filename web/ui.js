@@ -0,0 +1,221 @@
+'use strict';
+
+// the UI is served at <base>/ui/, the filter and explain endpoints at <base>/
+const base = new URL('../', location.href);
+
+const $ = (id) => document.getElementById(id);
+const inputs = ['feed-url', 'feed-user', 'feed-password', 'filter', 'out', 'name', 'interval'];
+
+let timer = null;
+let pending = null;
+
+// quote returns the value as a filter string literal, or as a time in
+// single quotes if q is "'".
+function quote(v, q = '"') {
+  return q + v.replace(/\\/g, '\\\\').replace(new RegExp(q, 'g'), '\\' + q) + q;
+}
+
+// dateFields are compared with times like '2024-01-01T00:00:00Z' or 'now-2d'.
+const dateFields = ['PublishedParsed', 'UpdatedParsed'];
+
+function addCondition() {
+  const value = $('b-value').value;
+  const op = $('b-op').value;
+  const q = dateFields.includes($('b-field').value) ? "'" : '"';
+  // in takes a list, e.g. Title in ("a", "b")
+  const expr = op === 'in' ? '(' + value.split(',').map((v) => quote(v.trim(), q)).join(', ') + ')' : quote(value, q);
+  let cond = $('b-field').value + ' ' + op + ' ' + expr;
+  if ($('b-not').checked) {
+    cond = 'not ' + cond;
+  }
+  const filter = $('filter').value.trim();
+  $('filter').value = filter === '' ? cond : filter + ' ' + $('b-link').value + ' ' + cond;
+  $('b-value').value = '';
+  changed();
+}
+
+function subscriptionUrl() {
+  const params = new URLSearchParams();
+  params.set('feed_url', $('feed-url').value.trim());
+  const filter = $('filter').value.trim();
+  if (filter !== '') {
+    params.set('filter', filter);
+  }
+  if ($('out').value !== '') {
+    params.set('out', $('out').value);
+  }
+  return base.href + '?' + params.toString();
+}
+
+function namedFeed() {
+  const fc = { name: $('name').value.trim() || 'my-feed', url: $('feed-url').value.trim() };
+  const filter = $('filter').value.trim();
+  if (filter !== '') {
+    fc.filter = filter;
+  }
+  if ($('out').value !== '') {
+    fc.out = $('out').value;
+  }
+  if ($('interval').value.trim() !== '') {
+    fc.interval = $('interval').value.trim();
+  }
+  if ($('feed-user').value !== '') {
+    fc.user = $('feed-user').value;
+  }
+  if ($('feed-password').value !== '') {
+    fc.password = $('feed-password').value;
+  }
+  return fc;
+}
+
+function updateResult() {
+  const hasUrl = $('feed-url').value.trim() !== '';
+  $('sub-url').value = hasUrl ? subscriptionUrl() : '';
+  $('config').value = hasUrl ? JSON.stringify(namedFeed(), null, 2) : '';
+}
+
+function changed() {
+  updateResult();
+  clearTimeout(timer);
+  timer = setTimeout(preview, 500);
+}
+
+function showError(msg) {
+  $('error').textContent = msg;
+  $('error').hidden = msg === '';
+}
+
+async function preview() {
+  const feedUrl = $('feed-url').value.trim();
+  if (feedUrl === '') {
+    return;
+  }
+  if (pending) {
+    pending.abort();
+  }
+  pending = new AbortController();
+
+  const params = new URLSearchParams({ feed_url: feedUrl, filter: $('filter').value.trim() });
+  const headers = {};
+  if ($('feed-user').value !== '' || $('feed-password').value !== '') {
+    headers['x-forward-user'] = $('feed-user').value;
+    headers['x-forward-password'] = $('feed-password').value;
+  }
+  $('summary').textContent = 'loading…';
+  let resp;
+  try {
+    resp = await fetch(new URL('explain?' + params.toString(), base), { headers: headers, signal: pending.signal });
+  } catch (e) {
+    if (e.name !== 'AbortError') {
+      $('summary').textContent = '';
+      showError('request failed: ' + e.message);
+    }
+    return;
+  }
+  if (!resp.ok) {
+    $('summary').textContent = '';
+    showError(resp.status + ': ' + (await resp.text() || resp.statusText));
+    return;
+  }
+  showError('');
+  render(await resp.json());
+}
+
+function render(e) {
+  $('summary').textContent = '(' + e.items_kept + ' of ' + e.items_in + ' items kept)';
+  const warnings = e.warnings || [];
+  $('warnings').textContent = warnings.join('\n');
+  $('warnings').hidden = warnings.length === 0;
+
+  const list = $('items');
+  list.textContent = '';
+  for (const item of e.items) {
+    const li = document.createElement('li');
+    li.className = item.kept ? 'kept' : 'dropped';
+
+    const title = document.createElement(item.link ? 'a' : 'span');
+    title.textContent = (item.kept ? '✔ ' : '✘ ') + (item.title || '(no title)');
+    if (item.link) {
+      title.href = item.link;
+      title.target = '_blank';
+      title.rel = 'noopener noreferrer';
+    }
+    li.appendChild(title);
+
+    if (item.decided_by) {
+      const why = document.createElement('div');
+      why.className = 'why';
+      why.textContent = 'decided by ' + item.decided_by;
+      if (item.error) {
+        const err = document.createElement('span');
+        err.className = 'error';
+        err.textContent = ' – ' + item.error;
+        why.appendChild(err);
+      }
+      li.appendChild(why);
+    }
+    list.appendChild(li);
+  }
+}
+
+// save creates the named feed with the admin API, the browser asks for
+// the admin credentials.
+async function save() {
+  const fc = namedFeed();
+  const result = $('save-result');
+  result.className = '';
+  result.textContent = 'saving…';
+  let resp;
+  try {
+    resp = await fetch(new URL('api/feeds', base), {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(fc),
+    });
+  } catch (e) {
+    result.className = 'error';
+    result.textContent = 'request failed: ' + e.message;
+    return;
+  }
+  if (resp.ok) {
+    result.textContent = 'saved, the feed is served at ' + new URL('feeds/' + encodeURIComponent(fc.name), base).href;
+    return;
+  }
+  result.className = 'error';
+  if (resp.status === 404) {
+    result.textContent = 'the admin API is not enabled, add the entry to the config file';
+    return;
+  }
+  let msg = resp.statusText;
+  try {
+    msg = (await resp.json()).error || msg;
+  } catch (e) {
+    // not a JSON error
+  }
+  result.textContent = resp.status + ': ' + msg;
+}
+
+async function copy(id) {
+  const el = $(id);
+  try {
+    await navigator.clipboard.writeText(el.value);
+  } catch (e) {
+    el.select();
+    document.execCommand('copy');
+  }
+}
+
+for (const id of inputs) {
+  $(id).addEventListener('input', changed);
+}
+$('b-add').addEventListener('click', addCondition);
+$('save').addEventListener('click', save);
+$('b-value').addEventListener('keydown', (ev) => {
+  if (ev.key === 'Enter') {
+    addCondition();
+  }
+});
+for (const btn of document.querySelectorAll('[data-copy]')) {
+  btn.addEventListener('click', () => copy(btn.dataset.copy));
+}
+updateResult();
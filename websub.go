@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	atomparser "github.com/mmcdole/gofeed/atom"
+	"github.com/rs/zerolog/log"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	websubLease       = 10 * 24 * time.Hour
+	websubMaxLease    = 30 * 24 * time.Hour
+	websubRetryDenied = 24 * time.Hour
+	websubAttempts    = 3
+	websubTimeout     = 30 * time.Second
+	websubMaxBody     = 10 << 20
+)
+
+var errPrivateCallback = errors.New("callback address is not public")
+
+// upstreamSubscription is a subscription of rss-filter to the hub of
+// an upstream feed. While a renewal is pending, the hub still signs the
+// content with the secret of the verified subscription, previous.
+type upstreamSubscription struct {
+	hub      string
+	topic    string
+	secret   string
+	previous string
+	expires  time.Time
+	pending  time.Time
+	denied   time.Time
+}
+
+// active reports whether the hub verified the subscription and the
+// lease did not expire.
+func (us *upstreamSubscription) active() bool {
+	return time.Now().Before(us.expires)
+}
+
+// subscription is a subscription of a client to one of our named feeds.
+type subscription struct {
+	callback string
+	secret   string
+	expires  time.Time
+}
+
+// websub implements both sides of WebSub (https://www.w3.org/TR/websub/).
+// As subscriber it subscribes to the hubs of upstream feeds, so content
+// is pushed instead of polled. As hub it distributes the filtered named
+// feeds to subscribed clients.
+type websub struct {
+	baseUrl   string
+	scheduler *scheduler
+
+	// client talks to upstream hubs, callbackClient to the subscribers.
+	// Anyone may subscribe, so callbackClient refuses to connect to
+	// private addresses unless allowPrivate is set.
+	client         *http.Client
+	callbackClient *http.Client
+	allowPrivate   bool
+
+	mu          sync.Mutex
+	upstream    map[string]*upstreamSubscription
+	subscribers map[string]map[string]*subscription
+
+	wg sync.WaitGroup
+}
+
+func newWebsub(baseUrl string, scheduler *scheduler, allowPrivate bool) *websub {
+	ws := &websub{
+		baseUrl:      strings.TrimSuffix(baseUrl, "/"),
+		scheduler:    scheduler,
+		client:       &http.Client{Timeout: websubTimeout},
+		allowPrivate: allowPrivate,
+		upstream:     map[string]*upstreamSubscription{},
+		subscribers:  map[string]map[string]*subscription{},
+	}
+	ws.callbackClient = callbackClient(allowPrivate)
+	scheduler.websub = ws
+	return ws
+}
+
+// callbackClient returns the client for requests to subscribers. The
+// address is checked when connecting, so neither a host name that
+// resolves to a private address nor a redirect can get around it.
+func callbackClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: websubTimeout}
+	if !allowPrivate {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("%w: %s", errPrivateCallback, host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport, Timeout: websubTimeout}
+}
+
+// isPrivateIP reports whether ip is a loopback, link-local, private or
+// unspecified address.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// validCallback checks the callback of a subscription request. Host
+// names are resolved when connecting, only literal addresses and
+// localhost are rejected here.
+func (ws *websub) validCallback(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback must be an http or https url")
+	}
+	if ws.allowPrivate {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateCallback
+	}
+	if ip := net.ParseIP(host); ip != nil && isPrivateIP(ip) {
+		return errPrivateCallback
+	}
+	return nil
+}
+
+func (ws *websub) hubUrl() string {
+	return ws.baseUrl + "/websub/hub"
+}
+
+func (ws *websub) topicUrl(name string) string {
+	return ws.baseUrl + "/feeds/" + url.PathEscape(name)
+}
+
+func (ws *websub) callbackUrl(name string) string {
+	return ws.baseUrl + "/websub/callback/" + url.PathEscape(name)
+}
+
+// links returns the links that are advertised in the named feed.
+func (ws *websub) links(name string) []feedLink {
+	return []feedLink{
+		{Rel: "hub", Href: ws.hubUrl()},
+		{Rel: "self", Href: ws.topicUrl(name)},
+	}
+}
+
+// linkHeader returns the value of the HTTP Link header for the named feed.
+func (ws *websub) linkHeader(name string) string {
+	var parts []string
+	for _, l := range ws.links(name) {
+		parts = append(parts, fmt.Sprintf(`<%s>; rel="%s"`, l.Href, l.Rel))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// pollInterval returns the poll interval of a feed that receives its
+// content from a hub. The feed is still polled as a fallback, often
+// enough to renew the subscription in time.
+func (ws *websub) pollInterval(name string) time.Duration {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	us, ok := ws.upstream[name]
+	if !ok || !us.active() {
+		return 0
+	}
+	d := time.Until(us.expires) / 2
+	if d > maxInterval {
+		d = maxInterval
+	}
+	return d
+}
+
+// discover subscribes to the hub of the upstream feed, if it advertises
+// one and there is no active subscription that is valid long enough.
+func (ws *websub) discover(ctx context.Context, fc *feedConfig, up *upstream) {
+	hub, topic := discoverHub(up)
+	if hub == "" {
+		return
+	}
+	if topic == "" {
+		topic = fc.URL
+	}
+
+	ws.mu.Lock()
+	us, ok := ws.upstream[fc.Name]
+	if ok && us.hub == hub && us.topic == topic {
+		renew := us.active() && time.Until(us.expires) < websubLease/2
+		pending := time.Since(us.pending) < time.Hour
+		denied := time.Since(us.denied) < websubRetryDenied
+		if (us.active() && !renew) || pending || denied {
+			ws.mu.Unlock()
+			return
+		}
+	}
+	us = &upstreamSubscription{
+		hub:     hub,
+		topic:   topic,
+		secret:  randomSecret(),
+		pending: time.Now(),
+	}
+	if old, ok := ws.upstream[fc.Name]; ok {
+		us.expires = old.expires
+		us.previous = old.previous
+		if old.active() && old.pending.IsZero() {
+			us.previous = old.secret
+		}
+	}
+	ws.upstream[fc.Name] = us
+	ws.mu.Unlock()
+
+	form := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {topic},
+		"hub.callback":      {ws.callbackUrl(fc.Name)},
+		"hub.secret":        {us.secret},
+		"hub.lease_seconds": {strconv.Itoa(int(websubLease.Seconds()))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		log.Err(err).Str("feed", fc.Name).Str("hub", hub).Msg("websub subscription failed")
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent())
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		log.Err(err).Str("feed", fc.Name).Str("hub", hub).Msg("websub subscription failed")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Error().Int("status_code", resp.StatusCode).Str("feed", fc.Name).Str("hub", hub).Msg("websub subscription failed")
+		return
+	}
+	log.Info().Str("feed", fc.Name).Str("hub", hub).Str("topic", topic).Msg("websub subscription requested")
+}
+
+// ServeHTTP handles the callbacks of upstream hubs, the verification of
+// intent (GET) and the content distribution (POST).
+func (ws *websub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/websub/callback/")
+	fc, ok := ws.scheduler.feed(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ws.verifyUpstream(w, r, fc)
+	case http.MethodPost:
+		ws.receive(w, r, fc)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (ws *websub) verifyUpstream(w http.ResponseWriter, r *http.Request, fc *feedConfig) {
+	q := r.URL.Query()
+	mode := q.Get("hub.mode")
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	us, ok := ws.upstream[fc.Name]
+	if !ok || q.Get("hub.topic") != us.topic {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch mode {
+	case "subscribe":
+		if us.pending.IsZero() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lease, err := strconv.Atoi(q.Get("hub.lease_seconds"))
+		if err != nil || lease <= 0 {
+			lease = int(websubLease.Seconds())
+		}
+		us.pending = time.Time{}
+		us.previous = ""
+		us.expires = time.Now().Add(time.Duration(lease) * time.Second)
+		log.Info().Str("feed", fc.Name).Str("hub", us.hub).Time("expires", us.expires).Msg("websub subscription verified")
+		_, _ = w.Write([]byte(q.Get("hub.challenge")))
+	case "denied":
+		us.pending = time.Time{}
+		us.denied = time.Now()
+		log.Warn().Str("feed", fc.Name).Str("hub", us.hub).Str("reason", q.Get("hub.reason")).Msg("websub subscription denied")
+		w.WriteHeader(http.StatusOK)
+	default:
+		// we never unsubscribe
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (ws *websub) receive(w http.ResponseWriter, r *http.Request, fc *feedConfig) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, websubMaxBody))
+	if err != nil {
+		var me *http.MaxBytesError
+		if errors.As(err, &me) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ws.mu.Lock()
+	us, ok := ws.upstream[fc.Name]
+	var secret, previous string
+	if ok {
+		secret, previous = us.secret, us.previous
+	}
+	ws.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// the content must be acknowledged even if the signature is invalid
+	w.WriteHeader(http.StatusAccepted)
+	signature := r.Header.Get("X-Hub-Signature")
+	if !validSignature(signature, secret, body) && (previous == "" || !validSignature(signature, previous, body)) {
+		log.Warn().Str("feed", fc.Name).Msg("websub content with invalid signature ignored")
+		return
+	}
+
+	feed, err := parseFeed(body)
+	if err != nil {
+		log.Err(err).Str("feed", fc.Name).Msg("parsing of pushed feed failed")
+		return
+	}
+	log.Debug().Str("feed", fc.Name).Int("items", len(feed.Items)).Msg("websub content received")
+	ws.scheduler.push(fc, &upstream{feed: feed, header: r.Header, body: body})
+}
+
+// serveHub handles subscription requests of clients to named feeds.
+func (ws *websub) serveHub(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	mode := r.PostForm.Get("hub.mode")
+	topic := r.PostForm.Get("hub.topic")
+	callback := r.PostForm.Get("hub.callback")
+	secret := r.PostForm.Get("hub.secret")
+
+	name, ok := ws.topicName(topic)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("unknown topic: %s", topic)))
+		return
+	}
+	if mode != "subscribe" && mode != "unsubscribe" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("unsupported mode: %s", mode)))
+		return
+	}
+	if err := ws.validCallback(callback); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(fmt.Sprintf("invalid callback %s: %s", callback, err.Error())))
+		return
+	}
+	if len(secret) >= 200 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("secret too long"))
+		return
+	}
+
+	lease := websubLease
+	if s, err := strconv.Atoi(r.PostForm.Get("hub.lease_seconds")); err == nil && s > 0 {
+		lease = time.Duration(s) * time.Second
+		if lease > websubMaxLease {
+			lease = websubMaxLease
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	ws.wg.Add(1)
+	go func() {
+		defer ws.wg.Done()
+		ws.verifySubscriber(name, mode, topic, callback, secret, lease)
+	}()
+}
+
+// topicName returns the name of the named feed that is identified by topic.
+func (ws *websub) topicName(topic string) (string, bool) {
+	prefix := ws.baseUrl + "/feeds/"
+	if !strings.HasPrefix(topic, prefix) {
+		return "", false
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(topic, prefix))
+	if err != nil {
+		return "", false
+	}
+	_, ok := ws.scheduler.feed(name)
+	return name, ok
+}
+
+// verifySubscriber verifies the intent of the subscriber and adds or
+// removes the subscription.
+func (ws *websub) verifySubscriber(name, mode, topic, callback, secret string, lease time.Duration) {
+	challenge := randomSecret()
+	u, _ := url.Parse(callback)
+	q := u.Query()
+	q.Set("hub.mode", mode)
+	q.Set("hub.topic", topic)
+	q.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		q.Set("hub.lease_seconds", strconv.Itoa(int(lease.Seconds())))
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := ws.callbackClient.Get(u.String())
+	if err != nil {
+		log.Err(err).Str("callback", callback).Msg("websub verification failed")
+		return
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(len(challenge))+1))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || string(data) != challenge {
+		log.Warn().Int("status_code", resp.StatusCode).Str("callback", callback).Msg("websub verification failed")
+		return
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	subs, ok := ws.subscribers[name]
+	if !ok {
+		subs = map[string]*subscription{}
+		ws.subscribers[name] = subs
+	}
+	if mode == "unsubscribe" {
+		delete(subs, callback)
+		log.Info().Str("feed", name).Str("callback", callback).Msg("websub subscriber removed")
+		return
+	}
+	subs[callback] = &subscription{
+		callback: callback,
+		secret:   secret,
+		expires:  time.Now().Add(lease),
+	}
+	log.Info().Str("feed", name).Str("callback", callback).Dur("lease", lease).Msg("websub subscriber added")
+}
+
+// wait blocks until pending verifications and deliveries are done, or
+// ctx is done.
+func (ws *websub) wait(ctx context.Context) error {
+	return waitGroup(ctx, &ws.wg)
+}
+
+// publish distributes the new content of the named feed to all subscribers.
+func (ws *websub) publish(name string, body []byte, contentType string) {
+	ws.mu.Lock()
+	var subs []*subscription
+	for cb, sub := range ws.subscribers[name] {
+		if time.Now().After(sub.expires) {
+			delete(ws.subscribers[name], cb)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	ws.mu.Unlock()
+
+	for _, sub := range subs {
+		ws.wg.Add(1)
+		go func(sub *subscription) {
+			defer ws.wg.Done()
+			ws.deliver(name, sub, body, contentType)
+		}(sub)
+	}
+}
+
+func (ws *websub) deliver(name string, sub *subscription, body []byte, contentType string) {
+	for attempt := 1; ; attempt++ {
+		err := ws.deliverOnce(name, sub, body, contentType)
+		if err == nil {
+			return
+		}
+		if attempt >= websubAttempts {
+			log.Err(err).Str("feed", name).Str("callback", sub.callback).Msg("websub delivery failed")
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (ws *websub) deliverOnce(name string, sub *subscription, body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPost, sub.callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Link", ws.linkHeader(name))
+	req.Header.Set("User-Agent", userAgent())
+	if sub.secret != "" {
+		mac := hmac.New(sha256.New, []byte(sub.secret))
+		mac.Write(body)
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ws.callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		ws.mu.Lock()
+		delete(ws.subscribers[name], sub.callback)
+		ws.mu.Unlock()
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("subscriber returned %s", resp.Status)
+	}
+	return nil
+}
+
+// discoverHub returns the hub and the self link of the upstream feed,
+// from the HTTP Link header or the links in the feed.
+func discoverHub(up *upstream) (hub, self string) {
+	for _, l := range parseLinkHeader(up.header.Values("Link")) {
+		if l.Rel == "hub" && hub == "" {
+			hub = l.Href
+		} else if l.Rel == "self" && self == "" {
+			self = l.Href
+		}
+	}
+	if hub != "" {
+		return hub, self
+	}
+
+	var links []feedLink
+	switch up.feed.FeedType {
+	case "atom":
+		if f, err := (&atomparser.Parser{}).Parse(bytes.NewReader(up.body)); err == nil {
+			for _, l := range f.Links {
+				links = append(links, feedLink{Rel: l.Rel, Href: l.Href})
+			}
+		}
+	case "rss":
+		for _, prefix := range []string{"atom", "atom10"} {
+			for _, e := range up.feed.Extensions[prefix]["link"] {
+				links = append(links, feedLink{Rel: e.Attrs["rel"], Href: e.Attrs["href"]})
+			}
+		}
+	}
+	for _, l := range links {
+		if l.Rel == "hub" && hub == "" {
+			hub = l.Href
+		} else if l.Rel == "self" && self == "" {
+			self = l.Href
+		}
+	}
+	return hub, self
+}
+
+// parseLinkHeader parses the values of HTTP Link headers (RFC 8288).
+func parseLinkHeader(values []string) []feedLink {
+	var links []feedLink
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			segs := strings.Split(part, ";")
+			href := strings.TrimSpace(segs[0])
+			if !strings.HasPrefix(href, "<") || !strings.HasSuffix(href, ">") {
+				continue
+			}
+			href = strings.Trim(href, "<>")
+			for _, seg := range segs[1:] {
+				k, v, _ := strings.Cut(strings.TrimSpace(seg), "=")
+				if !strings.EqualFold(k, "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(v, `"`)) {
+					links = append(links, feedLink{Rel: strings.ToLower(rel), Href: href})
+				}
+			}
+		}
+	}
+	return links
+}
+
+// validSignature checks the X-Hub-Signature header of pushed content.
+func validSignature(header, secret string, body []byte) bool {
+	if secret == "" {
+		return true
+	}
+	method, sig, ok := strings.Cut(header, "=")
+	if !ok {
+		return false
+	}
+	var h func() hash.Hash
+	switch method {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha384":
+		h = sha512.New384
+	case "sha512":
+		h = sha512.New
+	default:
+		return false
+	}
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func randomSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
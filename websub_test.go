@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/mmcdole/gofeed"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSubscriber is a WebSub subscriber that records the verifications
+// and deliveries it receives.
+type testSubscriber struct {
+	*httptest.Server
+	echo bool
+
+	mu         sync.Mutex
+	modes      []string
+	body       string
+	signature  string
+	deliveries int
+}
+
+func newTestSubscriber(t *testing.T, echo bool) *testSubscriber {
+	ts := &testSubscriber{echo: echo}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		if r.Method == http.MethodGet {
+			ts.modes = append(ts.modes, r.URL.Query().Get("hub.mode"))
+			if ts.echo {
+				_, _ = w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+			}
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		ts.body = string(data)
+		ts.signature = r.Header.Get("X-Hub-Signature")
+		ts.deliveries++
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func newTestWebsub(t *testing.T, allowPrivate bool) (*websub, *scheduler) {
+	t.Helper()
+	upstream, _ := newTestServer(t)
+	fc := &feedConfig{Name: "news", URL: upstream.URL + "/rss20.xml"}
+	if err := fc.validate(); err != nil {
+		t.Fatal(err)
+	}
+	sched := newScheduler(newFetcher(0), nil, []*feedConfig{fc}, defaultHostLimit, 5*time.Second)
+	return newWebsub("https://rss.example.org", sched, allowPrivate), sched
+}
+
+func hubRequest(t *testing.T, ws *websub, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/websub/hub", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	ws.serveHub(rec, req)
+	if err := ws.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestHubSubscribe(t *testing.T) {
+	ws, _ := newTestWebsub(t, true)
+	sub := newTestSubscriber(t, true)
+	form := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {ws.topicUrl("news")},
+		"hub.callback":      {sub.URL + "/cb"},
+		"hub.secret":        {"s3cret"},
+		"hub.lease_seconds": {"60"},
+	}
+	if rec := hubRequest(t, ws, form); rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	ws.mu.Lock()
+	s, ok := ws.subscribers["news"][sub.URL+"/cb"]
+	ws.mu.Unlock()
+	if !ok || s.secret != "s3cret" || time.Until(s.expires) > time.Minute {
+		t.Fatalf("subscription not added: %+v", s)
+	}
+
+	body := []byte("<rss/>")
+	ws.publish("news", body, "application/rss+xml")
+	if err := ws.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sub.mu.Lock()
+	if sub.deliveries != 1 || sub.body != string(body) || !validSignature(sub.signature, "s3cret", body) {
+		t.Errorf("delivery: %d, %q, signature %q", sub.deliveries, sub.body, sub.signature)
+	}
+	sub.mu.Unlock()
+
+	form.Set("hub.mode", "unsubscribe")
+	hubRequest(t, ws, form)
+	ws.mu.Lock()
+	n := len(ws.subscribers["news"])
+	ws.mu.Unlock()
+	if n != 0 {
+		t.Errorf("subscription not removed")
+	}
+	sub.mu.Lock()
+	if strings.Join(sub.modes, ",") != "subscribe,unsubscribe" {
+		t.Errorf("verifications: %q", sub.modes)
+	}
+	sub.mu.Unlock()
+}
+
+func TestHubVerificationFails(t *testing.T) {
+	ws, _ := newTestWebsub(t, true)
+	sub := newTestSubscriber(t, false)
+	hubRequest(t, ws, url.Values{
+		"hub.mode":     {"subscribe"},
+		"hub.topic":    {ws.topicUrl("news")},
+		"hub.callback": {sub.URL},
+	})
+	ws.mu.Lock()
+	n := len(ws.subscribers["news"])
+	ws.mu.Unlock()
+	if n != 0 {
+		t.Error("subscriber that didn't echo the challenge was added")
+	}
+}
+
+func TestHubRejectsRequests(t *testing.T) {
+	ws, _ := newTestWebsub(t, false)
+	sub := newTestSubscriber(t, true)
+	tests := []struct {
+		name  string
+		form  url.Values
+		check string
+	}{
+		{"unknown topic", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {ws.topicUrl("other")}, "hub.callback": {"https://example.org/cb"}}, "unknown topic"},
+		{"mode", url.Values{"hub.mode": {"publish"}, "hub.topic": {ws.topicUrl("news")}, "hub.callback": {"https://example.org/cb"}}, "unsupported mode"},
+		{"scheme", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {ws.topicUrl("news")}, "hub.callback": {"file:///etc/passwd"}}, "invalid callback"},
+		{"loopback", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {ws.topicUrl("news")}, "hub.callback": {sub.URL}}, "not public"},
+		{"localhost", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {ws.topicUrl("news")}, "hub.callback": {"http://localhost:8080/cb"}}, "not public"},
+	}
+	for _, tt := range tests {
+		rec := hubRequest(t, ws, tt.form)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.check) {
+			t.Errorf("%s: status %d: %s", tt.name, rec.Code, rec.Body.String())
+		}
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if len(sub.modes) != 0 {
+		t.Errorf("private callback was requested: %q", sub.modes)
+	}
+}
+
+func TestValidCallback(t *testing.T) {
+	ws := &websub{}
+	tests := []struct {
+		callback string
+		private  bool
+	}{
+		{"https://example.org/cb", false},
+		{"http://93.184.216.34:8080/cb", false},
+		{"http://127.0.0.1/cb", true},
+		{"http://[::1]/cb", true},
+		{"http://10.0.0.8/cb", true},
+		{"http://192.168.1.1/cb", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://[fe80::1]/cb", true},
+		{"http://0.0.0.0/cb", true},
+		{"http://LOCALHOST/cb", true},
+		{"http://app.localhost/cb", true},
+	}
+	for _, tt := range tests {
+		ws.allowPrivate = false
+		if err := ws.validCallback(tt.callback); errors.Is(err, errPrivateCallback) != tt.private {
+			t.Errorf("%s: got %v", tt.callback, err)
+		}
+		ws.allowPrivate = true
+		if err := ws.validCallback(tt.callback); err != nil {
+			t.Errorf("%s allowed: got %v", tt.callback, err)
+		}
+	}
+}
+
+func TestCallbackClient(t *testing.T) {
+	sub := newTestSubscriber(t, true)
+	// the host name resolves to a loopback address, which is refused when
+	// connecting
+	target := strings.Replace(sub.URL, "127.0.0.1", "localhost", 1)
+	if _, err := callbackClient(false).Get(target); !errors.Is(err, errPrivateCallback) {
+		t.Errorf("private address: got %v", err)
+	}
+	resp, err := callbackClient(true).Get(target)
+	if err != nil {
+		t.Fatalf("private address allowed: %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestDeliverGone(t *testing.T) {
+	ws, _ := newTestWebsub(t, true)
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	t.Cleanup(gone.Close)
+	ws.subscribers["news"] = map[string]*subscription{gone.URL: {callback: gone.URL, expires: time.Now().Add(time.Hour)}}
+	ws.publish("news", []byte("<rss/>"), "application/rss+xml")
+	if err := ws.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ws.subscribers["news"]) != 0 {
+		t.Error("subscriber that is gone was not removed")
+	}
+}
+
+func TestReceive(t *testing.T) {
+	ws, sched := newTestWebsub(t, false)
+	if st, ok := sched.get(context.Background(), "news"); !ok || st.itemsIn != 3 {
+		t.Fatalf("poll: %+v", st)
+	}
+	ws.upstream["news"] = &upstreamSubscription{hub: "https://hub.example.org", topic: "https://example.org/feed", secret: "s3cret"}
+
+	push := func(body string, sign bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/websub/callback/news", strings.NewReader(body))
+		if sign {
+			req.Header.Set("X-Hub-Signature", "sha256="+hmacHex("s3cret", body))
+		}
+		rec := httptest.NewRecorder()
+		ws.ServeHTTP(rec, req)
+		if err := sched.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+
+	// a fat ping with a new and an updated item
+	ping := `<?xml version="1.0"?><rss version="2.0"><channel><title>City news</title>
+<item><title>Bonn builds another bridge</title><guid>bridge-2</guid></item>
+<item><title>Sports: Bonn wins again</title><guid>sports-1</guid></item>
+</channel></rss>`
+	if code := push(ping, false); code != http.StatusAccepted {
+		t.Fatalf("status %d", code)
+	}
+	if st := sched.state("news"); st.itemsIn != 3 {
+		t.Errorf("unsigned content was not ignored: %d items", st.itemsIn)
+	}
+	push(ping, true)
+	st := sched.state("news")
+	var got []string
+	for _, item := range st.items {
+		got = append(got, item.Title)
+	}
+	if want := "Bonn builds another bridge,Sports: Bonn wins again,Bonn opens new bridge"; strings.Join(got, ",") != want {
+		t.Errorf("merged items: got %q, want %s", got, want)
+	}
+
+	if code := push(strings.Repeat("x", websubMaxBody+1), true); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large: status %d", code)
+	}
+}
+
+func hmacHex(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyUpstream(t *testing.T) {
+	ws, _ := newTestWebsub(t, false)
+	ws.upstream["news"] = &upstreamSubscription{hub: "https://hub.example.org", topic: "https://example.org/feed", pending: time.Now()}
+	verify := func(q url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ws.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/websub/callback/news?"+q.Encode(), nil))
+		return rec
+	}
+
+	if rec := verify(url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"https://example.org/other"}, "hub.challenge": {"abc"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("other topic: status %d", rec.Code)
+	}
+	rec := verify(url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"https://example.org/feed"}, "hub.challenge": {"abc"}, "hub.lease_seconds": {"3600"}})
+	if rec.Code != http.StatusOK || rec.Body.String() != "abc" {
+		t.Errorf("subscribe: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if d := ws.pollInterval("news"); d < 29*time.Minute || d > 30*time.Minute {
+		t.Errorf("poll interval of an active subscription: %s", d)
+	}
+	if rec := verify(url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"https://example.org/feed"}, "hub.challenge": {"abc"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("subscription that is not pending: status %d", rec.Code)
+	}
+	if rec := verify(url.Values{"hub.mode": {"unsubscribe"}, "hub.topic": {"https://example.org/feed"}, "hub.challenge": {"abc"}}); rec.Code != http.StatusNotFound {
+		t.Errorf("unsubscribe: status %d", rec.Code)
+	}
+}
+
+func TestReceiveDuringRenewal(t *testing.T) {
+	ws, sched := newTestWebsub(t, false)
+	if _, ok := sched.get(context.Background(), "news"); !ok {
+		t.Fatal("named feed not found")
+	}
+	var mu sync.Mutex
+	var secret string
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		mu.Lock()
+		secret = r.PostForm.Get("hub.secret")
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(hub.Close)
+
+	// the subscription expires soon and is renewed with a new secret
+	topic := "https://example.org/feed"
+	ws.upstream["news"] = &upstreamSubscription{hub: hub.URL, topic: topic, secret: "old", expires: time.Now().Add(time.Hour)}
+	fc, _ := sched.feed("news")
+	header := http.Header{"Link": {"<" + hub.URL + `>; rel="hub", <` + topic + `>; rel="self"`}}
+	ws.discover(context.Background(), fc, &upstream{feed: &gofeed.Feed{}, header: header})
+	mu.Lock()
+	renewed := secret
+	mu.Unlock()
+	if renewed == "" || renewed == "old" {
+		t.Fatalf("renewal with secret %q", renewed)
+	}
+
+	received := func(guid, secret string) bool {
+		body := `<?xml version="1.0"?><rss version="2.0"><channel><title>City news</title><item><title>` + guid + `</title><guid>` + guid + `</guid></item></channel></rss>`
+		req := httptest.NewRequest(http.MethodPost, "/websub/callback/news", strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature", "sha256="+hmacHex(secret, body))
+		ws.ServeHTTP(httptest.NewRecorder(), req)
+		if err := sched.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range sched.state("news").items {
+			if item.GUID == guid {
+				return true
+			}
+		}
+		return false
+	}
+	tests := []struct {
+		guid, secret string
+		verified     bool
+		want         bool
+	}{
+		{"old-pending", "old", false, true},
+		{"new-pending", renewed, false, true},
+		{"other-pending", "other", false, false},
+		{"old-verified", "old", true, false},
+		{"new-verified", renewed, true, true},
+	}
+	for _, tt := range tests {
+		if tt.verified {
+			q := url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.challenge": {"abc"}}
+			ws.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/websub/callback/news?"+q.Encode(), nil))
+		}
+		if got := received(tt.guid, tt.secret); got != tt.want {
+			t.Errorf("%s: received %t, want %t", tt.guid, got, tt.want)
+		}
+	}
+}